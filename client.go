@@ -2,22 +2,109 @@ package graceful
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// ErrCorruptFrame means that frame checksum or descriptors count do not match
+// its content. It is wrapped by *CorruptFrameError.
+var ErrCorruptFrame = errors.New("corrupt frame")
+
+// CorruptFrameError is returned by a Client when the server sent frame that
+// fails the integrity check (see Server.Checksum). All descriptors received
+// within such frame are closed.
+type CorruptFrameError struct {
+	// Offset is the offset within the frame entries at which the
+	// inconsistency was found.
+	Offset int
+
+	// Reason describes the inconsistency.
+	Reason string
+}
+
+func (e *CorruptFrameError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", ErrCorruptFrame, e.Offset, e.Reason)
+}
+
+// Unwrap returns ErrCorruptFrame.
+func (e *CorruptFrameError) Unwrap() error { return ErrCorruptFrame }
+
 // Errors used by Receive() function.
 var (
 	ErrEmptyControlMessage  = fmt.Errorf("empty control message")
 	ErrEmptyFileDescriptors = fmt.Errorf("empty file descriptors")
 )
 
+// Errors used to describe partially received frames.
+var (
+	// ErrControlTruncated means that some descriptors of the frame were
+	// discarded by the kernel or were not sent at all.
+	ErrControlTruncated = errors.New("control message truncated")
+
+	// ErrMessageTruncated means that meta bytes of the frame were received
+	// partially.
+	ErrMessageTruncated = errors.New("message truncated")
+)
+
+// TruncateError is returned by a Client when a frame was received partially.
+// All descriptors that did arrive within such frame are closed.
+type TruncateError struct {
+	// Err is ErrControlTruncated or ErrMessageTruncated.
+	Err error
+
+	// Received is a number of descriptors that arrived within the frame.
+	Received int
+
+	// Announced is a number of descriptors the frame was supposed to carry.
+	Announced int
+}
+
+func (e *TruncateError) Error() string {
+	return fmt.Sprintf(
+		"%v: received %d of %d descriptors",
+		e.Err, e.Received, e.Announced,
+	)
+}
+
+// Unwrap returns e.Err.
+func (e *TruncateError) Unwrap() error { return e.Err }
+
+// Errors used to describe client timeouts.
+var (
+	// ErrNoServer means that client failed to connect to the server in time.
+	ErrNoServer = errors.New("no server")
+
+	// ErrServerStalled means that server accepted the connection, but did
+	// not send all descriptors in time.
+	ErrServerStalled = errors.New("server stalled")
+)
+
+// TimeoutError is returned by a Client when it runs out of time given by its
+// timeouts or by the context's deadline.
+type TimeoutError struct {
+	// Err is ErrNoServer, ErrServerStalled or ErrHandoffInProgress.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "timeout: " + e.Err.Error()
+}
+
+// Timeout implements net.Error interface. It always returns true.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error interface. It always returns true.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// Unwrap returns e.Err.
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
 // ErrNotUnixConn is returned by a Client when not a *net.UnixConn is
 // passed to its Receive* methods.
 var ErrNotUnixConn = errors.New("not a unix connection")
@@ -28,13 +115,43 @@ var ErrNotUnixConn = errors.New("not a unix connection")
 // optional meta information represented by an io.Reader.
 //
 // If the callback returns non-nil error, then the function to which this
-// callback was given exits immediately with that error.
+// callback was given exits immediately with that error. Descriptors of the
+// same frame that are not passed to the callback yet are closed.
 //
 // Note that meta reader is only valid until callback returns.
 // If server does not provide additional information for descriptor, meta
 // argument will be nil.
 type ReceiveCallback func(fd int, meta io.Reader) error
 
+// NamedReceiveCallback is like ReceiveCallback, but it also receives the name
+// of the descriptor given by the server. Name is empty if server did not name
+// the descriptor.
+//
+// If server has no descriptor with the requested name, then callback is
+// called with that name and fd equal to -1.
+type NamedReceiveCallback func(name string, fd int, meta io.Reader) error
+
+func (cb ReceiveCallback) named() NamedReceiveCallback {
+	return func(_ string, fd int, meta io.Reader) error {
+		if fd < 0 {
+			// Missing descriptors are not reported to the ReceiveCallback.
+			return nil
+		}
+		return cb(fd, meta)
+	}
+}
+
+// entryCallback describes a function that will be called on each received
+// entry. Entry's fd is set to the received descriptor or to -1 for missing
+// entries.
+type entryCallback func(e entry, meta io.Reader) error
+
+func (cb NamedReceiveCallback) entries() entryCallback {
+	return func(e entry, meta io.Reader) error {
+		return cb(e.name, e.fd, meta)
+	}
+}
+
 // Receive dials to the "unix" network address addr and calls cb for each
 // received descriptor from it until EOF.
 func Receive(addr string, cb ReceiveCallback) error {
@@ -42,6 +159,20 @@ func Receive(addr string, cb ReceiveCallback) error {
 	return c.Receive(addr, cb)
 }
 
+// ReceiveContext is like Receive(), but it gives up when ctx is done.
+func ReceiveContext(ctx context.Context, addr string, cb ReceiveCallback) error {
+	c := Client{}
+	return c.ReceiveContext(ctx, addr, cb)
+}
+
+// ReceiveNamed dials to the "unix" network address addr, requests descriptors
+// with given names and calls cb for each received descriptor from it until
+// EOF.
+func ReceiveNamed(addr string, names []string, cb NamedReceiveCallback) error {
+	c := Client{}
+	return c.ReceiveNamed(addr, names, cb)
+}
+
 // ReceiveFrom reads a single control message from the given connection conn
 // and calls cb for each descriptor inside that message.
 func ReceiveFrom(conn net.Conn, cb ReceiveCallback) error {
@@ -66,11 +197,63 @@ type Client struct {
 	// OOBBufferSize defines size of the buffer for serialized descriptors.
 	// If OOBBufferSize is zero, then the default size is used.
 	//
-	// Note that client and server using this package MUST select the same
-	// buffer sizes. Another option is to use the global functions which use
-	// default sizes under the hood.
+	// Buffers grow when the server announces a frame larger than them. That
+	// is, these sizes matter only for servers that do not announce frame
+	// sizes, such as legacy servers or Send* functions. Such servers MUST
+	// select the same buffer sizes as the client.
 	MsgBufferSize, OOBBufferSize int
 
+	// NotifyReady tells the server that client reports its readiness to
+	// serve by calling Ready() after descriptors are received. If server
+	// supports it, connection is kept open until Ready() or NotReady() is
+	// called.
+	NotifyReady bool
+
+	// Lock makes client acquire the handoff lock tied to the server address
+	// before receiving descriptors (see LockHandoff()). The lock is released
+	// after descriptors are received or, if client reports readiness, after
+	// Ready() or NotReady() call. That is, at most one client with Lock set
+	// receives descriptors from the same server at a time.
+	//
+	// LockTimeout is the maximum duration to wait for the lock held by
+	// another process. If LockTimeout is zero, client fails with
+	// ErrHandoffInProgress immediately. Waiting is also limited by the
+	// context passed to Receive*Context() methods.
+	Lock        bool
+	LockTimeout time.Duration
+
+	// DialTimeout is the maximum duration to wait for the connection to the
+	// server. If it expires, then *TimeoutError with ErrNoServer is
+	// returned. If Retry is set, DialTimeout limits each attempt.
+	// If DialTimeout is zero, then only the context (if any) limits the
+	// dial.
+	DialTimeout time.Duration
+
+	// Retry is an optional policy of retrying failed connection to the
+	// server. If all attempts fail, then *DialError is returned.
+	// If Retry is nil, then dial is not retried.
+	Retry *RetryPolicy
+
+	// ReadTimeout is the maximum duration to wait for all descriptors after
+	// the connection is established. If it expires, then *TimeoutError with
+	// ErrServerStalled is returned.
+	// If ReadTimeout is zero, then only the context (if any) limits the
+	// reading.
+	ReadTimeout time.Duration
+
+	// OnState is an optional callback that is called on each state stream
+	// sent by the server (see StateWriter).
+	// If OnState is nil, then state streams are discarded.
+	OnState StateCallback
+
+	// Authorizer contains optional logic of checking credentials of the
+	// server. If Authorizer returns non-nil error, the connection is closed
+	// before any descriptor is received.
+	// If Authorizer is nil, then every server is allowed, except the case of
+	// abstract socket addresses, which could be bound by any process. For
+	// such addresses only servers of the same user are allowed by default.
+	Authorizer Authorizer
+
 	once sync.Once
 	msg  []byte
 	oob  []byte
@@ -79,36 +262,176 @@ type Client struct {
 // Receive dials to the "unix" network address addr and calls cb for each
 // received descriptor.
 func (c *Client) Receive(addr string, cb ReceiveCallback) error {
-	conn, err := net.Dial("unix", addr)
+	return c.receiveNamed(context.Background(), addr, nil, cb.named().entries())
+}
+
+// ReceiveContext is like Receive(), but it gives up when ctx is done.
+//
+// If ctx's deadline expires, then *TimeoutError is returned. If ctx is
+// canceled, then ctx.Err() is returned.
+func (c *Client) ReceiveContext(ctx context.Context, addr string, cb ReceiveCallback) error {
+	return c.receiveNamed(ctx, addr, nil, cb.named().entries())
+}
+
+// ReceiveNamed dials to the "unix" network address addr, requests descriptors
+// with given names and calls cb for each received descriptor. If names is
+// empty, then all descriptors are requested.
+//
+// Note that servers that do not support requests send all their descriptors
+// regardless of names.
+func (c *Client) ReceiveNamed(addr string, names []string, cb NamedReceiveCallback) error {
+	return c.receiveNamed(context.Background(), addr, names, cb.entries())
+}
+
+// ReceiveNamedContext is like ReceiveNamed(), but it gives up when ctx is
+// done. See ReceiveContext() for returned errors.
+func (c *Client) ReceiveNamedContext(ctx context.Context, addr string, names []string, cb NamedReceiveCallback) error {
+	return c.receiveNamed(ctx, addr, names, cb.entries())
+}
+
+func (c *Client) receiveNamed(ctx context.Context, addr string, names []string, cb entryCallback) error {
+	var lock *HandoffLock
+	if c.Lock {
+		var err error
+		lock, err = lockHandoffContext(ctx, addr, c.LockTimeout)
+		if err != nil {
+			return timeoutError(ctx, err, ErrHandoffInProgress)
+		}
+	}
+	conn, err := c.dial(ctx, addr, names)
 	if err != nil {
+		if lock != nil {
+			lock.Unlock()
+		}
 		return err
 	}
-	defer conn.Close()
+	h, err := c.receiveAllContext(ctx, conn, cb)
+	if err == nil && h.has(capReady) {
+		// Server waits for the readiness report. Connection is closed and
+		// lock is released by Ready() or NotReady().
+		keepReady(conn, lock)
+		return nil
+	}
+	conn.Close()
+	if lock != nil {
+		lock.Unlock()
+	}
+	return err
+}
 
-	return c.ReceiveAllFrom(conn, cb)
+// dial dials to the "unix" network address addr and sends the protocol
+// preamble followed by the request of descriptors with given names.
+func (c *Client) dial(ctx context.Context, addr string, names []string) (*net.UnixConn, error) {
+	conn, err := dialRetry(ctx, c.Retry, c.DialTimeout, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(conn, c.Authorizer, isAbstract(addr)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	h := hello{protoVersion, supportedCaps &^ optionalCaps}
+	if len(names) > 0 {
+		h.caps |= capRequest
+	}
+	if c.NotifyReady {
+		h.caps |= capReady
+	}
+	// Errors are not checked here cause server could have already sent all
+	// descriptors and closed the connection. Servers that do not speak the
+	// protocol preamble do not read it at all.
+	writeHello(conn, h)
+	if len(names) > 0 {
+		if err := writeRequest(conn, names); err == ErrLongWrite {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 // ReceiveFrom reads a single control message from the given connection conn
 // and calls cb for each descriptor inside that message.
 func (c *Client) ReceiveFrom(conn net.Conn, cb ReceiveCallback) error {
 	c.initOnce()
-	return receive(conn, c.msg, c.oob, cb)
+	var h hello
+	return c.receive(conn, &h, cb.named().entries())
 }
 
 // ReceiveAllFrom reads all control messages from the given connection conn and
 // calls cb for each descriptor inside those messages.
+//
+// If server supports acknowledgements, then after all messages are read
+// client acknowledges them. If some message or callback fails, then client
+// reports failure to the server.
 func (c *Client) ReceiveAllFrom(conn net.Conn, cb ReceiveCallback) error {
+	_, err := c.receiveAll(conn, cb.named().entries())
+	return err
+}
+
+// ReceiveAllFromContext is like ReceiveAllFrom(), but it gives up when ctx is
+// done or Client's ReadTimeout expires. See ReceiveContext() for returned
+// errors.
+//
+// Note that conn is not usable for i/o after ReceiveAllFromContext gives up.
+func (c *Client) ReceiveAllFromContext(ctx context.Context, conn net.Conn, cb ReceiveCallback) error {
+	_, err := c.receiveAllContext(ctx, conn, cb.named().entries())
+	return err
+}
+
+// receiveAllContext is like receiveAll(), but it interrupts receiving when
+// ctx is done or Client's ReadTimeout expires.
+func (c *Client) receiveAllContext(ctx context.Context, conn net.Conn, cb entryCallback) (hello, error) {
+	if c.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ReadTimeout)
+		defer cancel()
+	}
+	stop := watchContext(ctx, conn)
+	h, err := c.receiveAll(conn, cb)
+	stop()
+	if err != nil {
+		err = timeoutError(ctx, err, ErrServerStalled)
+	}
+	return h, err
+}
+
+// timeoutError returns *TimeoutError with reason if err is caused by ctx
+// deadline or by i/o timeout. If ctx is canceled, it returns ctx.Err().
+// Otherwise it returns err.
+func timeoutError(ctx context.Context, err, reason error) error {
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return &TimeoutError{Err: reason}
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case isTimeout(err):
+		return &TimeoutError{Err: reason}
+	}
+	return err
+}
+
+// receiveAll receives all frames from conn. It returns the reply to the
+// protocol preamble if server sent it.
+func (c *Client) receiveAll(conn net.Conn, cb entryCallback) (hello, error) {
 	c.initOnce()
+	var h hello
 	for {
-		err := receive(conn, c.msg, c.oob, cb)
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			return err
+		err := c.receive(conn, &h, cb)
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if h.has(capAck) {
+			// Error is not checked here cause server is free to close the
+			// connection without waiting for acknowledgement.
+			writeAck(conn.(*net.UnixConn), err)
 		}
+		return h, err
 	}
-	return nil
 }
 
 func (c *Client) initOnce() {
@@ -126,69 +449,206 @@ func (c *Client) initOnce() {
 	})
 }
 
-func receive(c net.Conn, msg, oob []byte, cb ReceiveCallback) error {
-	conn, ok := c.(*net.UnixConn)
+// receive reads a single frame from nc. If server replies to the protocol
+// preamble before the frame, then the reply is stored in h.
+func (c *Client) receive(nc net.Conn, h *hello, cb entryCallback) error {
+	conn, ok := nc.(*net.UnixConn)
 	if !ok {
 		return ErrNotUnixConn
 	}
-	msgn, oobn, _, _, err := conn.ReadMsgUnix(msg, oob)
-	if err != nil {
-		if isEOF(err) {
-			// Set err to io.EOF cause ReadMsgUnix returns net.OpError for
-			// EOF case.
-			err = io.EOF
-		}
-		return err
+	err := c.receiveNext(conn, h, cb)
+	if err != nil && isEOF(err) {
+		// Set err to io.EOF cause ReadMsgUnix returns net.OpError for EOF
+		// case.
+		err = io.EOF
 	}
+	return err
+}
 
-	cmsg, err := syscall.ParseSocketControlMessage(oob[:oobn])
-	if err != nil {
-		return err
+// receiveNext reads messages from conn until the first frame is received.
+func (c *Client) receiveNext(conn *net.UnixConn, h *hello, cb entryCallback) error {
+	for {
+		magic, err := readMagic(conn)
+		if err != nil {
+			return err
+		}
+		switch magic {
+		case helloMagic:
+			p := make([]byte, helloSize)
+			if _, err := io.ReadFull(conn, p); err != nil {
+				return err
+			}
+			if *h, err = decodeHello(p); err != nil {
+				return err
+			}
+
+		case frameMagic:
+			// Frame header is always sent by a separate write without
+			// descriptors. Thus reading exactly frameHeaderSize bytes does
+			// not touch the frame itself.
+			p := make([]byte, frameHeaderSize)
+			if _, err := io.ReadFull(conn, p); err != nil {
+				return err
+			}
+			fh, err := decodeFrameHeader(p)
+			if err != nil {
+				return err
+			}
+			var (
+				msg = growBytes(&c.msg, fh.msgn)
+				oob = growBytes(&c.oob, syscall.CmsgSpace(fh.fdn*4))
+			)
+			return receiveFrame(conn, fh, true, msg, oob, cb)
+
+		case stateMagic:
+			return receiveState(conn, c.OnState)
+
+		default:
+			return receiveFrame(conn, frameHeader{}, false, c.msg, c.oob, cb)
+		}
 	}
-	if len(cmsg) == 0 {
-		return ErrEmptyControlMessage
+}
+
+// growBytes grows *p to hold at least n bytes and returns its first n bytes.
+func growBytes(p *[]byte, n int) []byte {
+	if len(*p) < n {
+		*p = make([]byte, n)
 	}
-	fds, err := syscall.ParseUnixRights(&cmsg[0])
+	return (*p)[:n]
+}
+
+// receiveFrame reads a single frame from conn into given buffers and calls cb
+// for each received descriptor. If framed is true, then h describes the size
+// of the frame and msg is exactly of that size.
+//
+// If frame is received partially, then all received descriptors are closed
+// and *TruncateError is returned.
+func receiveFrame(conn *net.UnixConn, h frameHeader, framed bool, msg, oob []byte, cb entryCallback) error {
+	msgn, oobn, flags, _, err := conn.ReadMsgUnix(msg, oob)
 	if err != nil {
 		return err
 	}
-	if len(fds) == 0 {
-		return ErrEmptyFileDescriptors
+	var fds []int
+	if oobn > 0 {
+		cmsg, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		for i := range cmsg {
+			rights, err := syscall.ParseUnixRights(&cmsg[i])
+			if err != nil {
+				closeFds(fds)
+				return err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	if framed && msgn < len(msg) {
+		// Descriptors are always received with the first part of the frame.
+		// Read the rest of the frame that did not fit into the socket buffer.
+		if _, err := io.ReadFull(conn, msg[msgn:]); err != nil {
+			closeFds(fds)
+			return err
+		}
+		msgn = len(msg)
 	}
 
+	msg = msg[:msgn]
+	if framed && h.flags&frameChecksum != 0 {
+		var err error
+		if msg, err = checkFrameIntegrity(msg, h); err != nil {
+			closeFds(fds)
+			return err
+		}
+	}
+	entries, off := parseEntries(msg, h.flags&frameNamed != 0)
+	complete := off == len(msg)
 	var (
-		r = bytes.NewReader(msg[:msgn])
-		p = make([]byte, 4)
+		want      = countFds(entries)
+		announced = want
 	)
-	for _, fd := range fds {
-		// Read meta header.
-		if _, err := r.Read(p); err != nil {
-			return err
+	if framed {
+		announced = h.fdn
+	}
+	var trunc error
+	switch {
+	case flags&syscall.MSG_CTRUNC != 0:
+		trunc = ErrControlTruncated
+	case flags&syscall.MSG_TRUNC != 0:
+		trunc = ErrMessageTruncated
+	case !framed && oobn == 0:
+		return ErrEmptyControlMessage
+	case !framed && len(fds) == 0:
+		return ErrEmptyFileDescriptors
+	case len(fds) < announced || len(fds) < want:
+		trunc = ErrControlTruncated
+	case len(fds) > want || !complete:
+		trunc = ErrMessageTruncated
+	}
+	if trunc != nil {
+		closeFds(fds)
+		return &TruncateError{
+			Err:       trunc,
+			Received:  len(fds),
+			Announced: announced,
 		}
-		n := int64(binary.LittleEndian.Uint32(p))
+	}
 
+	for _, e := range entries {
+		e.fd = -1
+		if e.hasFd() {
+			e.fd, fds = fds[0], fds[1:]
+		}
 		var meta io.Reader
-		if n > 0 {
-			meta = io.LimitReader(r, n)
+		if len(e.meta) > 0 {
+			meta = bytes.NewReader(e.meta)
 		}
-		if err := cb(fd, meta); err != nil {
+		if err := cb(e, meta); err != nil {
+			// Close descriptors of the frame that callback did not get.
+			closeFds(fds)
 			return err
 		}
-		if meta != nil {
-			// Ensure that all meta bytes was read.
-			_, err := io.Copy(ioutil.Discard, meta)
-			if err != nil {
-				return err
-			}
-		}
 	}
 
 	return nil
 }
 
-func isEOF(err error) bool {
-	if opErr, ok := err.(*net.OpError); ok {
-		err = opErr.Err
+// checkFrameIntegrity verifies the trailer of the frame msg and consistency
+// of its entries with the header h. It returns frame entries without the
+// trailer.
+func checkFrameIntegrity(msg []byte, h frameHeader) ([]byte, error) {
+	msg, err := checkFrameTrailer(msg, h.fdn)
+	if err != nil {
+		return nil, err
+	}
+	entries, off := parseEntries(msg, h.flags&frameNamed != 0)
+	if off < len(msg) {
+		return nil, &CorruptFrameError{
+			Offset: off,
+			Reason: "malformed entry",
+		}
 	}
-	return err == io.EOF
+	if n := countFds(entries); n != h.fdn {
+		return nil, &CorruptFrameError{
+			Offset: off,
+			Reason: fmt.Sprintf("entries describe %d descriptors; header announced %d", n, h.fdn),
+		}
+	}
+	return msg, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// isEOF reports whether err means that peer has closed the connection.
+//
+// Note that peer closing the connection with unread data (such as the
+// protocol preamble sent to the server that does not speak it) leads to
+// ECONNRESET instead of EOF.
+func isEOF(err error) bool {
+	err = underlyingError(err)
+	return err == io.EOF || err == syscall.ECONNRESET
 }
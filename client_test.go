@@ -2,11 +2,14 @@ package graceful
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -86,3 +89,391 @@ type descriptor struct {
 	fd   int
 	meta []byte
 }
+
+func TestClientBufferSizes(t *testing.T) {
+	client, server, err := unixSocketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	meta := bytes.Repeat([]byte{'m'}, 5000)
+	s := Server{
+		MsgBufferSize: 8192,
+		OOBBufferSize: 8192,
+	}
+	rw, err := s.newResponseWriter(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.hello = hello{protoVersion, capFrameHeader}
+	for i := 0; i < 10; i++ {
+		if err := rw.Write(int(f.Fd()), bytes.NewReader(meta)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	c := Client{
+		MsgBufferSize: 16,
+		OOBBufferSize: 16,
+	}
+	var n int
+	err = c.ReceiveAllFrom(client, func(fd int, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, meta) {
+			t.Errorf("unexpected meta of #%d descriptor: %d bytes", n, len(b))
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := n, 10; act != exp {
+		t.Errorf("unexpected number of received descriptors: %d; want %d", act, exp)
+	}
+}
+
+func TestClientLegacyFrame(t *testing.T) {
+	client, server, err := unixSocketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Legacy frame is a sequence of meta lengths and meta bytes without any
+	// preceding frame header.
+	msg := []byte{4, 0, 0, 0, 'm', 'e', 't', 'a', 0, 0, 0, 0}
+	oob := syscall.UnixRights(int(f.Fd()), int(f.Fd()))
+	if _, _, err := server.WriteMsgUnix(msg, oob, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	var ds []descriptor
+	err = ReceiveAllFrom(client, func(fd int, r io.Reader) error {
+		var b []byte
+		if r != nil {
+			b, _ = ioutil.ReadAll(r)
+		}
+		ds = append(ds, descriptor{fd, b})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := len(ds), 2; act != exp {
+		t.Fatalf("unexpected number of received descriptors: %d; want %d", act, exp)
+	}
+	if act, exp := string(ds[0].meta), "meta"; act != exp {
+		t.Errorf("unexpected meta of #0 descriptor: %q; want %q", act, exp)
+	}
+	if ds[1].meta != nil {
+		t.Errorf("unexpected meta of #1 descriptor: %q; want nil", ds[1].meta)
+	}
+}
+
+func TestClientTruncatedFrame(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		msgn int
+		oobn int
+		msg  []byte
+		fdn  int
+		err  *TruncateError
+	}{
+		{
+			name: "control",
+			oobn: syscall.CmsgLen(4),
+			msg:  []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			fdn:  3,
+			err: &TruncateError{
+				Err:       ErrControlTruncated,
+				Received:  1,
+				Announced: 3,
+			},
+		},
+		{
+			name: "message",
+			msgn: 8,
+			msg:  []byte{4, 0, 0, 0, 'm', 'e', 't', 'a', 4, 0, 0, 0, 'm', 'e', 't', 'a'},
+			fdn:  2,
+			err: &TruncateError{
+				Err:       ErrMessageTruncated,
+				Received:  2,
+				Announced: 1,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server, err := unixSocketpair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			defer server.Close()
+
+			f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			fds := make([]int, test.fdn)
+			for i := range fds {
+				fds[i] = int(f.Fd())
+			}
+			_, _, err = server.WriteMsgUnix(test.msg, syscall.UnixRights(fds...), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := Client{
+				MsgBufferSize: test.msgn,
+				OOBBufferSize: test.oobn,
+			}
+			before := openFds(t)
+			err = c.ReceiveFrom(client, func(int, io.Reader) error {
+				t.Errorf("unexpected callback call")
+				return nil
+			})
+			terr, ok := err.(*TruncateError)
+			if !ok {
+				t.Fatalf("unexpected error: %v; want %v", err, test.err)
+			}
+			if *terr != *test.err {
+				t.Errorf("unexpected error: %v; want %v", terr, test.err)
+			}
+			if act, exp := openFds(t), before; act != exp {
+				t.Errorf("unexpected number of open descriptors: %d; want %d", act, exp)
+			}
+		})
+	}
+}
+
+func TestClientBadFrame(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		h    frameHeader
+	}{
+		{"size", frameHeader{msgn: maxFrameSize + 1}},
+		{"descriptors", frameHeader{fdn: maxFrameFds + 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server, err := unixSocketpair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if err := writeFrameHeader(server, test.h); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+
+			err = ReceiveAllFrom(client, func(int, io.Reader) error {
+				t.Errorf("unexpected callback call")
+				return nil
+			})
+			if err != ErrBadFrame {
+				t.Errorf("unexpected error: %v; want %v", err, ErrBadFrame)
+			}
+		})
+	}
+}
+
+func TestClientReceiveContext(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		readTimeout time.Duration
+		timeout     time.Duration
+		cancel      time.Duration
+		err         error
+	}{
+		{
+			name:        "read timeout",
+			readTimeout: 50 * time.Millisecond,
+			err:         &TimeoutError{ErrServerStalled},
+		},
+		{
+			name:    "deadline",
+			timeout: 50 * time.Millisecond,
+			err:     &TimeoutError{ErrServerStalled},
+		},
+		{
+			name:    "no server",
+			timeout: -1,
+			err:     &TimeoutError{ErrNoServer},
+		},
+		{
+			name:   "canceled",
+			cancel: 50 * time.Millisecond,
+			err:    context.Canceled,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			// Server accepts connection, but never sends anything.
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}()
+
+			ctx := context.Background()
+			if test.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			if test.cancel != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(test.cancel, cancel)
+			}
+			client := &Client{ReadTimeout: test.readTimeout}
+			done := make(chan error, 1)
+			go func() {
+				done <- client.ReceiveContext(ctx, ln.Addr().String(), func(int, io.Reader) error {
+					t.Errorf("unexpected callback call")
+					return nil
+				})
+			}()
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("client did not give up")
+			}
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("unexpected error: %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestClientCorruptFrame(t *testing.T) {
+	// Two unnamed entries: "meta" and empty meta.
+	entries := []byte{4, 0, 0, 0, 'm', 'e', 't', 'a', 0, 0, 0, 0}
+	for _, test := range []struct {
+		name   string
+		msg    []byte
+		offset int
+	}{
+		{
+			name: "valid",
+			msg:  appendFrameTrailer(append([]byte(nil), entries...), 2),
+		},
+		{
+			name: "checksum",
+			msg: func() []byte {
+				msg := appendFrameTrailer(append([]byte(nil), entries...), 2)
+				msg[5] = 'E'
+				return msg
+			}(),
+			offset: len(entries),
+		},
+		{
+			name:   "trailer fds",
+			msg:    appendFrameTrailer(append([]byte(nil), entries...), 3),
+			offset: len(entries) + 4,
+		},
+		{
+			name:   "malformed entry",
+			msg:    appendFrameTrailer([]byte{4, 0, 0, 0, 'm', 'e', 't', 'a', 9, 0, 0, 0}, 2),
+			offset: 8,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server, err := unixSocketpair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			h := frameHeader{
+				msgn:  len(test.msg),
+				fdn:   2,
+				flags: frameChecksum,
+			}
+			if err := writeFrameHeader(server, h); err != nil {
+				t.Fatal(err)
+			}
+			oob := syscall.UnixRights(int(f.Fd()), int(f.Fd()))
+			if _, _, err := server.WriteMsgUnix(test.msg, oob, nil); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+
+			before := openFds(t)
+			var n int
+			err = ReceiveAllFrom(client, func(fd int, _ io.Reader) error {
+				n++
+				return syscall.Close(fd)
+			})
+			if test.offset == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != 2 {
+					t.Errorf("unexpected number of received descriptors: %d; want 2", n)
+				}
+				return
+			}
+			cerr, ok := err.(*CorruptFrameError)
+			if !ok {
+				t.Fatalf("unexpected error: %v; want *CorruptFrameError", err)
+			}
+			if act, exp := cerr.Offset, test.offset; act != exp {
+				t.Errorf("unexpected offset: %d; want %d (%v)", act, exp, cerr)
+			}
+			if act, exp := openFds(t), before; act != exp {
+				t.Errorf("unexpected number of open descriptors: %d; want %d", act, exp)
+			}
+		})
+	}
+}
+
+func openFds(t *testing.T) int {
+	fis, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can not count open descriptors: %v", err)
+	}
+	return len(fis)
+}
@@ -0,0 +1,308 @@
+package graceful
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// ErrUnknownMetaCodec is returned when meta is encoded by a codec that is not
+// registered by RegisterMetaCodec().
+var ErrUnknownMetaCodec = errors.New("graceful: unknown meta codec")
+
+// MetaCodec describes an encoding of Meta.
+type MetaCodec interface {
+	// ID returns codec identifier, which is recorded within encoded meta to
+	// select the codec on decoding. Identifiers below 16 are reserved by
+	// this package.
+	ID() byte
+
+	// Encode writes encoded m to w.
+	Encode(w io.Writer, m Meta) error
+
+	// Decode reads and decodes meta from r.
+	Decode(r io.Reader) (Meta, error)
+}
+
+// Codecs implemented by this package.
+var (
+	// GobCodec encodes Meta by encoding/gob package. It is the default codec.
+	// For compatibility with older versions of this package its identifier
+	// is not recorded within encoded meta.
+	GobCodec MetaCodec = gobCodec{}
+
+	// JSONCodec encodes Meta as a JSON object. Note that decoded numbers are
+	// float64.
+	JSONCodec MetaCodec = jsonCodec{}
+
+	// KVCodec encodes Meta as a list of length-prefixed keys and typed
+	// values. It supports string, []byte, bool, integer and floating point
+	// values. Decoded integers are int64 or uint64, floats are float64.
+	//
+	// Encoded meta starts with 4 bytes of little-endian number of pairs.
+	// Each pair is encoded as 2 bytes of little-endian key length, key bytes,
+	// a byte of value type, 4 bytes of little-endian value length and value
+	// bytes. Numbers are encoded as 8 bytes in little-endian order.
+	KVCodec MetaCodec = kvCodec{}
+)
+
+// metaMagic prefixes meta encoded by any codec except GobCodec, and is
+// followed by a byte of codec identifier.
+//
+// Gob encoded Meta always starts with a type definition, which second byte
+// is 0xff. Thus it can not be confused with metaMagic.
+var metaMagic = [3]byte{'G', 'R', 'M'}
+
+const metaHeaderSize = 4
+
+var codecs = struct {
+	mu sync.RWMutex
+	m  map[byte]MetaCodec
+}{
+	m: map[byte]MetaCodec{
+		JSONCodec.ID(): JSONCodec,
+		KVCodec.ID():   KVCodec,
+	},
+}
+
+// RegisterMetaCodec makes codec c available for decoding by MetaFrom(). It
+// panics if codec with the same identifier is already registered.
+func RegisterMetaCodec(c MetaCodec) {
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	id := c.ID()
+	if id == GobCodec.ID() {
+		panic("graceful: meta codec identifier is reserved for gob")
+	}
+	if _, has := codecs.m[id]; has {
+		panic(fmt.Sprintf("graceful: meta codec %d is already registered", id))
+	}
+	codecs.m[id] = c
+}
+
+func lookupCodec(id byte) MetaCodec {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	return codecs.m[id]
+}
+
+// encodeMeta writes meta m encoded by codec c to w.
+func encodeMeta(w io.Writer, c MetaCodec, m Meta) error {
+	if c == nil || c.ID() == GobCodec.ID() {
+		return GobCodec.Encode(w, m)
+	}
+	h := [metaHeaderSize]byte{
+		metaMagic[0], metaMagic[1], metaMagic[2], c.ID(),
+	}
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	return c.Encode(w, m)
+}
+
+// decodeMeta reads meta from r selecting the codec by its header.
+func decodeMeta(r io.Reader) (Meta, error) {
+	var h [metaHeaderSize]byte
+	n, err := io.ReadFull(r, h[:])
+	if err == nil && string(h[:3]) == string(metaMagic[:]) {
+		c := lookupCodec(h[3])
+		if c == nil {
+			return nil, ErrUnknownMetaCodec
+		}
+		return c.Decode(r)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return GobCodec.Decode(io.MultiReader(bytes.NewReader(h[:n]), r))
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte { return 0 }
+
+func (gobCodec) Encode(w io.Writer, m Meta) error {
+	return gob.NewEncoder(w).Encode(m)
+}
+
+func (gobCodec) Decode(r io.Reader) (m Meta, err error) {
+	err = gob.NewDecoder(r).Decode(&m)
+	return m, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte { return 1 }
+
+func (jsonCodec) Encode(w io.Writer, m Meta) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (jsonCodec) Decode(r io.Reader) (m Meta, err error) {
+	err = json.NewDecoder(r).Decode(&m)
+	return m, err
+}
+
+// Value types of the KVCodec.
+const (
+	kvString = 's'
+	kvBytes  = 'b'
+	kvBool   = 't'
+	kvInt    = 'i'
+	kvUint   = 'u'
+	kvFloat  = 'f'
+)
+
+// Limits of the KVCodec.
+const (
+	kvMaxKey  = 0xffff
+	kvMaxSize = 1 << 20
+)
+
+type kvCodec struct{}
+
+func (kvCodec) ID() byte { return 2 }
+
+func (kvCodec) Encode(w io.Writer, m Meta) error {
+	p := make([]byte, 4)
+	binary.LittleEndian.PutUint32(p, uint32(len(m)))
+	for k, v := range m {
+		if len(k) > kvMaxKey {
+			return fmt.Errorf("graceful: meta key %.32q... is too long", k)
+		}
+		t, b, err := kvEncodeValue(v)
+		if err != nil {
+			return fmt.Errorf("graceful: meta key %q: %v", k, err)
+		}
+		var h [7]byte
+		binary.LittleEndian.PutUint16(h[:], uint16(len(k)))
+		p = append(p, h[:2]...)
+		p = append(p, k...)
+		h[2] = t
+		binary.LittleEndian.PutUint32(h[3:], uint32(len(b)))
+		p = append(p, h[2:]...)
+		p = append(p, b...)
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+func (kvCodec) Decode(r io.Reader) (Meta, error) {
+	var h [7]byte
+	if _, err := io.ReadFull(r, h[:4]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(h[:])
+	m := make(Meta)
+	for i := uint32(0); i < n; i++ {
+		if _, err := io.ReadFull(r, h[:2]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		k := make([]byte, binary.LittleEndian.Uint16(h[:]))
+		if _, err := io.ReadFull(r, k); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if _, err := io.ReadFull(r, h[2:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		size := binary.LittleEndian.Uint32(h[3:])
+		if size > kvMaxSize {
+			return nil, fmt.Errorf("graceful: meta value of key %q is too large", k)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		v, err := kvDecodeValue(h[2], b)
+		if err != nil {
+			return nil, fmt.Errorf("graceful: meta key %q: %v", k, err)
+		}
+		m[string(k)] = v
+	}
+	return m, nil
+}
+
+func kvEncodeValue(v interface{}) (t byte, b []byte, err error) {
+	var x uint64
+	switch v := v.(type) {
+	case string:
+		return kvString, []byte(v), nil
+	case []byte:
+		return kvBytes, v, nil
+	case bool:
+		if v {
+			return kvBool, []byte{1}, nil
+		}
+		return kvBool, []byte{0}, nil
+	case int:
+		t, x = kvInt, uint64(v)
+	case int8:
+		t, x = kvInt, uint64(v)
+	case int16:
+		t, x = kvInt, uint64(v)
+	case int32:
+		t, x = kvInt, uint64(v)
+	case int64:
+		t, x = kvInt, uint64(v)
+	case uint:
+		t, x = kvUint, uint64(v)
+	case uint8:
+		t, x = kvUint, uint64(v)
+	case uint16:
+		t, x = kvUint, uint64(v)
+	case uint32:
+		t, x = kvUint, uint64(v)
+	case uint64:
+		t, x = kvUint, v
+	case float32:
+		t, x = kvFloat, math.Float64bits(float64(v))
+	case float64:
+		t, x = kvFloat, math.Float64bits(v)
+	default:
+		return 0, nil, fmt.Errorf("unsupported value type %T", v)
+	}
+	b = make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, x)
+	return t, b, nil
+}
+
+func kvDecodeValue(t byte, b []byte) (interface{}, error) {
+	switch t {
+	case kvString:
+		return string(b), nil
+	case kvBytes:
+		return b, nil
+	case kvBool:
+		if len(b) != 1 {
+			return nil, fmt.Errorf("malformed bool value")
+		}
+		return b[0] != 0, nil
+	case kvInt, kvUint, kvFloat:
+		if len(b) != 8 {
+			return nil, fmt.Errorf("malformed number value")
+		}
+		x := binary.LittleEndian.Uint64(b)
+		switch t {
+		case kvInt:
+			return int64(x), nil
+		case kvUint:
+			return x, nil
+		default:
+			return math.Float64frombits(x), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown value type %q", t)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
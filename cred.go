@@ -0,0 +1,139 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrPeerCredUnsupported is returned when peer credentials can not be
+// retrieved on the current platform.
+var ErrPeerCredUnsupported = errors.New("peer credentials are not supported")
+
+// PeerCred contains credentials of the process on the other side of a unix
+// connection, as they were at the time of connect().
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerCredFrom returns credentials of the peer connected to conn.
+// Note that conn must be a *net.UnixConn.
+func PeerCredFrom(conn net.Conn) (PeerCred, error) {
+	c, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, ErrNotUnixConn
+	}
+	return peerCred(c)
+}
+
+// AuthError is returned by the Authorizers provided by this package when
+// the peer is not allowed to receive descriptors.
+type AuthError struct {
+	Cred   PeerCred
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf(
+		"peer pid=%d uid=%d gid=%d is not authorized: %s",
+		e.Cred.PID, e.Cred.UID, e.Cred.GID, e.Reason,
+	)
+}
+
+// Authorizer describes an object that decides whether the peer with given
+// credentials is allowed to receive descriptors.
+type Authorizer interface {
+	Authorize(PeerCred) error
+}
+
+// AuthorizerFunc is an adapter to allow the use of ordinary functions as
+// Authorizers.
+type AuthorizerFunc func(PeerCred) error
+
+// Authorize calls a(cred).
+func (a AuthorizerFunc) Authorize(cred PeerCred) error {
+	return a(cred)
+}
+
+// SameUserAuthorizer returns an Authorizer that allows only peers running
+// with the same user id as the current process.
+func SameUserAuthorizer() Authorizer {
+	uid := uint32(os.Getuid())
+	return AuthorizerFunc(func(cred PeerCred) error {
+		if cred.UID != uid {
+			return &AuthError{cred, fmt.Sprintf("uid is not %d", uid)}
+		}
+		return nil
+	})
+}
+
+// AllowlistAuthorizer returns an Authorizer that allows peers which user id
+// is listed in uids or which group id is listed in gids.
+func AllowlistAuthorizer(uids, gids []uint32) Authorizer {
+	return AuthorizerFunc(func(cred PeerCred) error {
+		for _, uid := range uids {
+			if cred.UID == uid {
+				return nil
+			}
+		}
+		for _, gid := range gids {
+			if cred.GID == gid {
+				return nil
+			}
+		}
+		return &AuthError{cred, "neither uid nor gid is allowed"}
+	})
+}
+
+// SameExecutableAuthorizer returns an Authorizer that allows only peers
+// running the same executable file as the current process.
+func SameExecutableAuthorizer() Authorizer {
+	return AuthorizerFunc(func(cred PeerCred) error {
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		peer, err := peerExecutable(cred)
+		if err != nil {
+			return err
+		}
+		if peer != self {
+			return &AuthError{cred, fmt.Sprintf("executable %q is not %q", peer, self)}
+		}
+		return nil
+	})
+}
+
+// AllAuthorizer returns an Authorizer that allows a peer only if every given
+// Authorizer allows it. Authorizers are called in sequence and the first
+// error is returned.
+func AllAuthorizer(as ...Authorizer) Authorizer {
+	return AuthorizerFunc(func(cred PeerCred) error {
+		for _, a := range as {
+			if err := a.Authorize(cred); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// authorize checks credentials of the peer connected to conn by a. If a is
+// nil, then every peer is allowed unless abstract is true. In that case only
+// peers of the same user are allowed.
+func authorize(conn *net.UnixConn, a Authorizer, abstract bool) error {
+	if a == nil && abstract {
+		a = SameUserAuthorizer()
+	}
+	if a == nil {
+		return nil
+	}
+	cred, err := peerCred(conn)
+	if err != nil {
+		return err
+	}
+	return a.Authorize(cred)
+}
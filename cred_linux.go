@@ -0,0 +1,44 @@
+package graceful
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func peerCred(conn *net.UnixConn) (cred PeerCred, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return cred, err
+	}
+	var ucred *syscall.Ucred
+	cerr := rc.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		)
+	})
+	if cerr != nil {
+		return cred, cerr
+	}
+	if err != nil {
+		return cred, os.NewSyscallError("getsockopt", err)
+	}
+	return PeerCred{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}, nil
+}
+
+func peerExecutable(cred PeerCred) (string, error) {
+	path, err := os.Readlink("/proc/" + strconv.Itoa(int(cred.PID)) + "/exe")
+	if err != nil {
+		return "", err
+	}
+	// Kernel marks executable that is replaced or removed from disk after
+	// start. Strip the mark like os.Executable() does, so the old instance is
+	// still recognized after the binary is updated.
+	return strings.TrimSuffix(path, " (deleted)"), nil
+}
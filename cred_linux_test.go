@@ -0,0 +1,198 @@
+package graceful
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const envDeletedExeTest = "GRACEFUL_TEST_DELETED_EXE"
+
+func TestPeerCredFrom(t *testing.T) {
+	client, server, err := unixSocketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	cred, err := PeerCredFrom(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := PeerCred{
+		PID: int32(os.Getpid()),
+		UID: uint32(os.Getuid()),
+		GID: uint32(os.Getgid()),
+	}
+	if cred != exp {
+		t.Errorf("PeerCredFrom() = %+v; want %+v", cred, exp)
+	}
+}
+
+func TestAuthorizers(t *testing.T) {
+	self := PeerCred{
+		PID: int32(os.Getpid()),
+		UID: uint32(os.Getuid()),
+		GID: uint32(os.Getgid()),
+	}
+	other := PeerCred{
+		PID: 1,
+		UID: self.UID + 1,
+		GID: self.GID + 1,
+	}
+	for _, test := range []struct {
+		name string
+		auth Authorizer
+		cred PeerCred
+		err  bool
+	}{
+		{"same uid", SameUserAuthorizer(), self, false},
+		{"other uid", SameUserAuthorizer(), other, true},
+		{"allowed uid", AllowlistAuthorizer([]uint32{other.UID}, nil), other, false},
+		{"allowed gid", AllowlistAuthorizer(nil, []uint32{other.GID}), other, false},
+		{"not allowed", AllowlistAuthorizer([]uint32{self.UID}, []uint32{self.GID}), other, true},
+		{"same executable", SameExecutableAuthorizer(), self, false},
+		{"all", AllAuthorizer(SameUserAuthorizer(), SameExecutableAuthorizer()), self, false},
+		{"all rejects", AllAuthorizer(SameExecutableAuthorizer(), SameUserAuthorizer()), PeerCred{PID: self.PID, UID: other.UID}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.auth.Authorize(test.cred)
+			if test.err && err == nil {
+				t.Errorf("Authorize() = nil; want error")
+			}
+			if !test.err && err != nil {
+				t.Errorf("Authorize() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, test := range []struct {
+		name string
+		auth Authorizer
+		exp  int
+	}{
+		{"allow", SameUserAuthorizer(), 1},
+		{"reject", AllowlistAuthorizer(nil, nil), 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			handled := make(chan struct{}, 1)
+			server := &Server{
+				Handler: SequenceHandler(
+					CallbackHandler(func() { handled <- struct{}{} }),
+					FileHandler(f, nil),
+				),
+				Authorizer: test.auth,
+			}
+			go server.Serve(ln)
+			defer server.Close()
+
+			var act int
+			err = Receive(ln.Addr().String(), func(int, io.Reader) error {
+				act++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act != test.exp {
+				t.Errorf("received %d descriptors; want %d", act, test.exp)
+			}
+			server.Shutdown(context.Background())
+			if act, exp := len(handled) > 0, test.exp > 0; act != exp {
+				t.Errorf("handler called: %t; want %t", act, exp)
+			}
+		})
+	}
+}
+
+func TestPeerExecutableDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "graceful.test")
+	if err := ioutil.WriteFile(path, p, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(path, "-test.run=^TestPeerExecutableDeletedChild$")
+	cmd.Env = append(os.Environ(), envDeletedExeTest+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Readlink("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(link, " (deleted)") {
+		t.Skipf("executable link is not marked as deleted: %q", link)
+	}
+	exe, err := peerExecutable(PeerCred{PID: int32(cmd.Process.Pid)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != path {
+		t.Errorf("peerExecutable() = %q; want %q", exe, path)
+	}
+
+	// Let the child authorize itself with its binary removed.
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child process error: %v\n%s", err, out.String())
+	}
+}
+
+// TestPeerExecutableDeletedChild is run by TestPeerExecutableDeleted in a
+// child process which executable is removed from disk.
+func TestPeerExecutableDeletedChild(t *testing.T) {
+	if os.Getenv(envDeletedExeTest) == "" {
+		t.Skip("not a child process")
+	}
+	// Wait for the parent to remove our executable.
+	ioutil.ReadAll(os.Stdin)
+
+	self := PeerCred{PID: int32(os.Getpid())}
+	if err := SameExecutableAuthorizer().Authorize(self); err != nil {
+		t.Fatalf("Authorize() unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package graceful
+
+import "net"
+
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, ErrPeerCredUnsupported
+}
+
+func peerExecutable(cred PeerCred) (string, error) {
+	return "", ErrPeerCredUnsupported
+}
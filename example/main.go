@@ -33,7 +33,18 @@ func main() {
 	)
 	// First assume that some application instance is already running.
 	// Then we could try to request an active listener's descriptor from it.
-	err = graceful.Receive(*sock, func(fd int, meta io.Reader) error {
+	// We will report our readiness to it when we start serving.
+	// Connection is retried for a while cause running instance could be
+	// re-creating its socket right now.
+	client := graceful.Client{
+		NotifyReady: true,
+		Retry: &graceful.RetryPolicy{
+			Attempts: 5,
+			Backoff:  50 * time.Millisecond,
+			Jitter:   0.2,
+		},
+	}
+	err = client.Receive(*sock, func(fd int, meta io.Reader) error {
 		ln, err = graceful.FdListener(fd)
 		return err
 	})
@@ -60,6 +71,9 @@ func main() {
 	})}
 	go server.Serve(ln)
 
+	// Tell the previous instance (if any) that we are serving now.
+	graceful.Ready()
+
 	// Create graceful server socket to pass current listener to the new
 	// application instance in the future.
 	gln, err := net.Listen("unix", *sock)
@@ -71,9 +85,11 @@ func main() {
 	// application has been started.
 	restart := make(chan struct{})
 
-	go graceful.Serve(gln, graceful.SequenceHandler(
+	var gserver *graceful.Server
+	gserver = &graceful.Server{Handler: graceful.SequenceHandler(
 		// This "handler" will close graceful socket. This will help us to
-		// avoid races on next socket creation.
+		// avoid races on next socket creation: the new instance creates it
+		// right after it reports readiness.
 		graceful.CallbackHandler(func() {
 			gln.Close()
 		}),
@@ -82,11 +98,25 @@ func main() {
 		// client.
 		graceful.ListenerHandler(ln, nil),
 
-		// This "handler" closes restart channel, signaling that we can exit.
-		graceful.CallbackHandler(func() {
-			close(restart)
+		// This handler waits for the new instance to report that it is
+		// serving received listener. Then it closes restart channel,
+		// signaling that we can exit. If new instance failed, we re-create
+		// graceful socket and keep serving, so the next instance could try
+		// again.
+		graceful.ReadyHandler(func(err error) {
+			if err == nil {
+				close(restart)
+				return
+			}
+			log.Printf("new instance failed: %v; keep serving", err)
+			if gln, err = net.Listen("unix", *sock); err != nil {
+				log.Printf("can not listen on %q: %v", *sock, err)
+				return
+			}
+			go gserver.Serve(gln)
 		}),
-	))
+	)}
+	go gserver.Serve(gln)
 
 	// Catch SIGINT signal to cleanup gln listener.
 	sig := make(chan os.Signal, 1)
@@ -95,11 +125,14 @@ func main() {
 	// Lock on restart until the new app comes.
 	select {
 	case <-restart:
+		// Wait for the listener descriptor to be flushed to the new
+		// instance.
+		gserver.Shutdown(context.Background())
 		// Wait all accepted connection to be processed before exit.
 		log.Printf("stopping server %q", name)
 		server.Shutdown(context.Background())
 	case <-sig:
-		gln.Close()
+		gserver.Close()
 	}
 }
 
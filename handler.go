@@ -1,6 +1,7 @@
 package graceful
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -47,7 +48,7 @@ func SendListener(resp ResponseWriter, ln net.Listener, meta io.WriterTo) error
 	if err != nil {
 		return err
 	}
-	return SendFile(resp, f, meta)
+	return sendDup(resp, KindListener, f, meta)
 }
 
 // SendConn sends a connection conn with given meta to the ResponseWriter.
@@ -56,7 +57,7 @@ func SendConn(resp ResponseWriter, conn net.Conn, meta io.WriterTo) error {
 	if err != nil {
 		return err
 	}
-	return SendFile(resp, f, meta)
+	return sendDup(resp, addrKind(KindConn, conn.LocalAddr()), f, meta)
 }
 
 // SendPacketConn sends a connection conn with given meta to the ResponseWriter.
@@ -65,12 +66,30 @@ func SendPacketConn(resp ResponseWriter, conn net.PacketConn, meta io.WriterTo)
 	if err != nil {
 		return err
 	}
-	return SendFile(resp, f, meta)
+	return sendDup(resp, addrKind(KindPacketConn, conn.LocalAddr()), f, meta)
 }
 
 // SendFile sends a file f with given meta to the ResponseWriter.
 func SendFile(resp ResponseWriter, file *os.File, meta io.WriterTo) error {
-	return resp.Write(int(file.Fd()), meta)
+	return sendFile(resp, KindFile, file, meta)
+}
+
+// sendFile sends a file f with given meta to the ResponseWriter. If client
+// supports it, file is tagged with given kind.
+func sendFile(resp ResponseWriter, kind Kind, file *os.File, meta io.WriterTo) error {
+	return writeEntry(resp, entry{fd: int(file.Fd()), kind: kind}, meta)
+}
+
+// sendDup is like sendFile, but it also passes ownership of file to the
+// ResponseWriter. That is, file is closed once it is flushed or failed to be
+// written.
+func sendDup(resp ResponseWriter, kind Kind, file *os.File, meta io.WriterTo) error {
+	if err := sendFile(resp, kind, file, meta); err != nil {
+		file.Close()
+		return err
+	}
+	own(resp, file)
+	return nil
 }
 
 // ListenerHandler returns a Handler that sends listener ln with given meta to
@@ -138,6 +157,66 @@ func SequenceHandler(hs ...Handler) Handler {
 	})
 }
 
+// WaitAck waits for the client acknowledgement of all descriptors written to
+// resp. It returns ErrAckUnsupported if resp does not implement Acknowledger.
+// See Acknowledger for details.
+func WaitAck(ctx context.Context, resp ResponseWriter) error {
+	a, ok := resp.(Acknowledger)
+	if !ok {
+		return ErrAckUnsupported
+	}
+	return a.WaitAck(ctx)
+}
+
+// WaitReady waits for the client to report its readiness. It returns
+// ErrReadyUnsupported if resp does not implement Readier. See Readier for
+// details.
+func WaitReady(ctx context.Context, resp ResponseWriter) error {
+	r, ok := resp.(Readier)
+	if !ok {
+		return ErrReadyUnsupported
+	}
+	return r.WaitReady(ctx)
+}
+
+// Requested returns names of descriptors requested by the client. It returns
+// nil if client did not request particular descriptors or resp does not
+// implement Requester.
+func Requested(resp ResponseWriter) []string {
+	r, ok := resp.(Requester)
+	if !ok {
+		return nil
+	}
+	return r.Requested()
+}
+
+// AckHandler returns a Handler that waits for the client acknowledgement of
+// descriptors sent by previous handlers and then calls cb with the result.
+// That is, cb receives nil error only if client successfully handled all
+// received descriptors.
+//
+// Note that AckHandler must be the last one in the SequenceHandler because
+// no descriptors can be sent after acknowledgement.
+func AckHandler(cb func(error)) Handler {
+	return HandlerFunc(func(_ net.Conn, resp ResponseWriter) {
+		cb(WaitAck(context.Background(), resp))
+	})
+}
+
+// ReadyHandler returns a Handler that waits for the client to report its
+// readiness to serve descriptors sent by previous handlers and then calls cb
+// with the result. That is, cb receives nil error only if client is ready and
+// it is safe to stop serving shared objects. Otherwise the server should keep
+// serving them.
+//
+// Note that ReadyHandler must be the last one in the SequenceHandler because
+// no descriptors can be sent after acknowledgement.
+func ReadyHandler(cb func(error)) Handler {
+	return HandlerFunc(func(_ net.Conn, resp ResponseWriter) {
+		cb(WaitReady(context.Background(), resp))
+	})
+}
+
 func fileFrom(v interface{}) (*os.File, error) {
 	f, ok := v.(filer)
 	if !ok {
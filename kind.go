@@ -0,0 +1,69 @@
+package graceful
+
+import "net"
+
+// Kind describes a type of the object which descriptor is shared.
+type Kind uint8
+
+// Kinds of shared objects.
+//
+// KindListener and KindConn describe stream sockets, while KindPacketConn
+// describes datagram sockets except unix ones, which are described by
+// KindUnixgram.
+const (
+	KindUnknown Kind = iota
+	KindListener
+	KindConn
+	KindPacketConn
+	KindUnixgram
+	KindFile
+)
+
+var kindNames = [...]string{
+	KindUnknown:    "unknown",
+	KindListener:   "listener",
+	KindConn:       "conn",
+	KindPacketConn: "packetconn",
+	KindUnixgram:   "unixgram",
+	KindFile:       "file",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return kindNames[KindUnknown]
+}
+
+// ParseKind returns Kind which String() is equal to s. It returns
+// KindUnknown if there is no such Kind.
+func ParseKind(s string) Kind {
+	for k, name := range kindNames {
+		if name == s {
+			return Kind(k)
+		}
+	}
+	return KindUnknown
+}
+
+// oneOf reports whether k is unknown or is one of the given kinds.
+func (k Kind) oneOf(kinds []Kind) bool {
+	if k == KindUnknown {
+		return true
+	}
+	for _, kind := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// addrKind returns KindUnixgram if addr is a "unixgram" address and kind
+// otherwise.
+func addrKind(kind Kind, addr net.Addr) Kind {
+	if addr != nil && addr.Network() == "unixgram" {
+		return KindUnixgram
+	}
+	return kind
+}
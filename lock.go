@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrHandoffInProgress is returned when the handoff lock is held by another
+// process.
+var ErrHandoffInProgress = errors.New("graceful: another handoff is in progress")
+
+// lockPollInterval is how often LockHandoff retries to acquire the lock.
+const lockPollInterval = 10 * time.Millisecond
+
+// HandoffLock is an exclusive lock tied to the graceful server address. It
+// allows at most one successor to receive descriptors at a time.
+//
+// For filesystem addresses the lock is flock(2) on the file next to the
+// socket file, which name is the address with ".lock" suffix. The lock file
+// is not removed on unlock. For abstract addresses the lock is the bound
+// abstract socket with the same suffix.
+//
+// The lock is released when the process exits.
+type HandoffLock struct {
+	file *os.File
+	ln   *net.UnixListener
+}
+
+// LockHandoff acquires the handoff lock tied to the address addr. If the lock
+// is held by another process, it waits up to timeout for it to be released
+// and returns ErrHandoffInProgress if it was not. If timeout is zero, then
+// LockHandoff does not wait.
+func LockHandoff(addr string, timeout time.Duration) (*HandoffLock, error) {
+	return lockHandoffContext(context.Background(), addr, timeout)
+}
+
+// lockHandoffContext is like LockHandoff(), but it also gives up waiting when
+// ctx is done. In that case ctx.Err() is returned.
+func lockHandoffContext(ctx context.Context, addr string, timeout time.Duration) (*HandoffLock, error) {
+	if err := checkAddr(addr); err != nil {
+		return nil, err
+	}
+	name := addr + ".lock"
+
+	var file *os.File
+	if !isAbstract(addr) {
+		var err error
+		file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err := tryLock(name, file)
+		if err == nil {
+			return l, nil
+		}
+		if err == ErrHandoffInProgress && time.Now().Before(deadline) {
+			t := time.NewTimer(lockPollInterval)
+			select {
+			case <-t.C:
+				continue
+			case <-ctx.Done():
+				t.Stop()
+				err = ctx.Err()
+			}
+		}
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+}
+
+// tryLock tries to acquire the lock once. If file is nil, then name is an
+// abstract socket address.
+func tryLock(name string, file *os.File) (*HandoffLock, error) {
+	if file == nil {
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: name, Net: "unix"})
+		if isErrno(err, syscall.EADDRINUSE) {
+			return nil, ErrHandoffInProgress
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &HandoffLock{ln: ln}, nil
+	}
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil, ErrHandoffInProgress
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("flock", err)
+	}
+	return &HandoffLock{file: file}, nil
+}
+
+// Unlock releases the lock.
+func (l *HandoffLock) Unlock() error {
+	if l.ln != nil {
+		return l.ln.Close()
+	}
+	// Closing the file releases the lock.
+	return l.file.Close()
+}
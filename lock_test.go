@@ -0,0 +1,108 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addrs := []string{
+		filepath.Join(dir, "graceful.sock"),
+	}
+	if abstractSupported {
+		addrs = append(addrs, fmt.Sprintf("@graceful-test-lock-%d", os.Getpid()))
+	}
+	for _, addr := range addrs {
+		t.Run(addr, func(t *testing.T) {
+			first, err := LockHandoff(addr, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LockHandoff(addr, 0); err != ErrHandoffInProgress {
+				t.Fatalf("unexpected error: %v; want %v", err, ErrHandoffInProgress)
+			}
+			if _, err := LockHandoff(addr, 50*time.Millisecond); err != ErrHandoffInProgress {
+				t.Fatalf("unexpected error: %v; want %v", err, ErrHandoffInProgress)
+			}
+
+			time.AfterFunc(50*time.Millisecond, func() {
+				first.Unlock()
+			})
+			second, err := LockHandoff(addr, 5*time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := second.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientLock(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "graceful.sock")
+
+	lock, err := LockHandoff(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	client := &Client{Lock: true}
+	err = client.Receive(addr, func(int, io.Reader) error {
+		return nil
+	})
+	if err != ErrHandoffInProgress {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrHandoffInProgress)
+	}
+}
+
+func TestClientLockContext(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "graceful.sock")
+
+	lock, err := LockHandoff(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	client := &Client{
+		Lock:        true,
+		LockTimeout: 10 * time.Second,
+	}
+	start := time.Now()
+	err = client.ReceiveContext(ctx, addr, func(int, io.Reader) error {
+		return nil
+	})
+	if terr, ok := err.(*TimeoutError); !ok || terr.Err != ErrHandoffInProgress {
+		t.Fatalf("unexpected error: %v; want timeout of %v", err, ErrHandoffInProgress)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lock was awaited for %s after context deadline", d)
+	}
+}
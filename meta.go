@@ -1,30 +1,52 @@
 package graceful
 
 import (
-	"encoding/gob"
 	"io"
 )
 
 // Meta is a helper type that is marshaled/unmarshaled by `endoding/gob`
 // package and could be used as an additional information for a descriptor.
+//
+// Meta could be encoded by other codecs as well (see WithCodec()). Codec is
+// recorded within encoded meta, so MetaFrom() and ReadFrom() select it
+// automatically.
 type Meta map[string]interface{}
 
+// MetaFrom reads and decodes Meta from r by the codec it was encoded with.
 func MetaFrom(r io.Reader) (Meta, error) {
 	m := make(Meta)
 	_, err := m.ReadFrom(r)
 	return m, err
 }
 
+// WithCodec returns io.WriterTo that writes m encoded by codec c. If c is
+// nil, then GobCodec is used.
+func (m Meta) WithCodec(c MetaCodec) io.WriterTo {
+	return codedMeta{m, c}
+}
+
 func (m Meta) WriteTo(w io.Writer) (int64, error) {
-	wc := &writeCounter{W: w}
-	enc := gob.NewEncoder(wc)
-	return wc.N, enc.Encode(m)
+	return m.WithCodec(GobCodec).WriteTo(w)
 }
 
 func (m *Meta) ReadFrom(r io.Reader) (int64, error) {
 	rc := &readCounter{R: r}
-	dec := gob.NewDecoder(rc)
-	return rc.N, dec.Decode(m)
+	x, err := decodeMeta(rc)
+	if err == nil {
+		*m = x
+	}
+	return rc.N, err
+}
+
+type codedMeta struct {
+	meta  Meta
+	codec MetaCodec
+}
+
+func (c codedMeta) WriteTo(w io.Writer) (int64, error) {
+	wc := &writeCounter{W: w}
+	err := encodeMeta(wc, c.codec, c.meta)
+	return wc.N, err
 }
 
 type readCounter struct {
@@ -2,6 +2,8 @@ package graceful
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -28,3 +30,73 @@ func TestMeta(t *testing.T) {
 		t.Fatalf("unequal results:\n%+v\n%+v", m1, m2)
 	}
 }
+
+func TestMetaCodec(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		codec MetaCodec
+		meta  Meta
+	}{
+		{
+			name:  "gob",
+			codec: GobCodec,
+			meta:  Meta{"foo": "bar", "baz": 1},
+		},
+		{
+			name:  "json",
+			codec: JSONCodec,
+			meta:  Meta{"foo": "bar", "baz": 1.5, "ok": true},
+		},
+		{
+			name:  "kv",
+			codec: KVCodec,
+			meta: Meta{
+				"foo": "bar",
+				"int": int64(-42),
+				"u64": uint64(42),
+				"flt": 0.5,
+				"ok":  true,
+				"raw": []byte{0, 1, 2},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			n, err := test.meta.WithCodec(test.codec).WriteTo(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act, exp := int(n), buf.Len(); act != exp {
+				t.Fatalf("unexpected number of wrote bytes: %d; want %d", act, exp)
+			}
+			m, err := MetaFrom(buf)
+			if err != nil {
+				t.Fatalf("MetaFrom() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(m, test.meta) {
+				t.Fatalf("unequal results:\n%+v\n%+v", m, test.meta)
+			}
+		})
+	}
+}
+
+func TestMetaCodecUnknown(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Meta{"foo": "bar"}.WithCodec(testCodec{}).WriteTo(buf)
+	if _, err := MetaFrom(buf); err != ErrUnknownMetaCodec {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrUnknownMetaCodec)
+	}
+}
+
+func TestMetaCodecKVUnsupported(t *testing.T) {
+	_, err := Meta{"foo": []string{"bar"}}.WithCodec(KVCodec).WriteTo(ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected error for unsupported value type")
+	}
+}
+
+type testCodec struct{}
+
+func (testCodec) ID() byte                             { return 255 }
+func (testCodec) Encode(io.Writer, Meta) error         { return nil }
+func (testCodec) Decode(io.Reader) (m Meta, err error) { return m, nil }
@@ -0,0 +1,127 @@
+package graceful
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// entryWriter describes a ResponseWriter that can tag descriptors with names
+// and kinds.
+type entryWriter interface {
+	writeEntry(e entry, meta io.WriterTo) error
+}
+
+// writeEntry writes e to resp. If resp does not implement entryWriter, then
+// e is written as an ordinary descriptor without name and kind.
+func writeEntry(resp ResponseWriter, e entry, meta io.WriterTo) error {
+	if ew, ok := resp.(entryWriter); ok {
+		return ew.writeEntry(e, meta)
+	}
+	if !e.hasFd() {
+		return nil
+	}
+	return resp.Write(e.fd, meta)
+}
+
+// own passes ownership of c to resp. If resp does not implement Owner, then c
+// is left to the garbage collector.
+func own(resp ResponseWriter, c io.Closer) {
+	if o, ok := resp.(Owner); ok {
+		o.Own(c)
+	}
+}
+
+// writeMissing tells the client that there is no descriptor with given name.
+func writeMissing(resp ResponseWriter, name string) {
+	resp.Debugf("descriptor %q is not found", name)
+	err := writeEntry(resp, entry{name: name, flags: entryMissing}, nil)
+	if err != nil {
+		resp.Errorf("send not found %q error: %v", name, err)
+	}
+}
+
+// ServeMux is a Handler that sends descriptors registered by names.
+//
+// If client requested particular names, ServeMux calls only handlers
+// registered for those names and replies with "not found" entries for the
+// names that are not registered. Otherwise, all registered handlers are
+// called in order of registration.
+//
+// Descriptors sent by a registered handler are tagged with the name it was
+// registered for. Client receives that name within NamedReceiveCallback.
+type ServeMux struct {
+	mu    sync.RWMutex
+	names []string
+	m     map[string]Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Register registers handler h for the given name.
+// If a handler already exists for name, Register panics.
+func (m *ServeMux) Register(name string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "" {
+		panic("graceful: empty name")
+	}
+	if h == nil {
+		panic("graceful: nil handler")
+	}
+	if _, exist := m.m[name]; exist {
+		panic("graceful: multiple registrations for " + name)
+	}
+	if m.m == nil {
+		m.m = make(map[string]Handler)
+	}
+	m.m[name] = h
+	m.names = append(m.names, name)
+}
+
+// Handle sends descriptors requested by the client.
+func (m *ServeMux) Handle(conn net.Conn, resp ResponseWriter) {
+	names := Requested(resp)
+	if names == nil {
+		m.mu.RLock()
+		names = append([]string(nil), m.names...)
+		m.mu.RUnlock()
+	}
+	for _, name := range names {
+		m.mu.RLock()
+		h, ok := m.m[name]
+		m.mu.RUnlock()
+		if ok {
+			h.Handle(conn, namedResponse{resp, name})
+			continue
+		}
+		writeMissing(resp, name)
+	}
+}
+
+// namedResponse is a ResponseWriter that tags every written descriptor with
+// the name.
+type namedResponse struct {
+	ResponseWriter
+	name string
+}
+
+func (r namedResponse) Write(fd int, meta io.WriterTo) error {
+	return r.writeEntry(entry{fd: fd}, meta)
+}
+
+func (r namedResponse) writeEntry(e entry, meta io.WriterTo) error {
+	e.name = r.name
+	return writeEntry(r.ResponseWriter, e, meta)
+}
+
+func (r namedResponse) Own(c io.Closer) {
+	own(r.ResponseWriter, c)
+}
+
+func (r namedResponse) OpenState(name string) (io.WriteCloser, error) {
+	return OpenState(r.ResponseWriter, name)
+}
@@ -0,0 +1,117 @@
+package graceful
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServeMux(t *testing.T) {
+	a, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(a.Name())
+	defer a.Close()
+	b, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(b.Name())
+	defer b.Close()
+
+	mux := NewServeMux()
+	mux.Register("a", FileHandler(a, nil))
+	mux.Register("b", FileHandler(b, nil))
+
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		HandshakeTimeout: 10 * time.Millisecond,
+		Handler:          mux,
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	for _, test := range []struct {
+		name  string
+		names []string
+		exp   []string
+		files []*os.File
+	}{
+		{
+			name:  "all",
+			exp:   []string{"a", "b"},
+			files: []*os.File{a, b},
+		},
+		{
+			name:  "subset",
+			names: []string{"b"},
+			exp:   []string{"b"},
+			files: []*os.File{b},
+		},
+		{
+			name:  "not found",
+			names: []string{"c", "a"},
+			exp:   []string{"c", "a"},
+			files: []*os.File{nil, a},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				names []string
+				fds   []int
+			)
+			err := ReceiveNamed(ln.Addr().String(), test.names, func(name string, fd int, _ io.Reader) error {
+				names = append(names, name)
+				fds = append(fds, fd)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.exp) {
+				t.Fatalf("received names %q; want %q", names, test.exp)
+			}
+			for i, f := range test.files {
+				if f == nil {
+					if fds[i] != -1 {
+						t.Errorf("descriptor %q is %d; want -1", names[i], fds[i])
+					}
+					continue
+				}
+				same, err := sameFile(fds[i], int(f.Fd()))
+				if err != nil {
+					t.Errorf("fstat error: %v", err)
+				} else if !same {
+					t.Errorf("descriptor %q is not the same file", names[i])
+				}
+			}
+		})
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		conn, err := net.Dial("unix", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var n int
+		err = ReceiveAllFrom(conn, func(int, io.Reader) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("received %d descriptors; want 2", n)
+		}
+	})
+}
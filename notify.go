@@ -0,0 +1,72 @@
+package graceful
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envNotifySocket is an environment variable that holds the address of the
+// systemd notification socket.
+const envNotifySocket = "NOTIFY_SOCKET"
+
+// Notifier sends service state notifications to systemd as described by
+// sd_notify(3). It is useful for services with Type=notify.
+//
+// All methods of Notifier are no-op if there is no notification socket.
+type Notifier struct {
+	// Addr is the address of the notification socket. Addresses starting
+	// with '@' are abstract ones.
+	// If Addr is empty, then NOTIFY_SOCKET environment variable is used.
+	Addr string
+}
+
+// Notify sends given state assignments, such as "READY=1", to systemd.
+func (n *Notifier) Notify(state ...string) error {
+	addr := n.Addr
+	if addr == "" {
+		addr = os.Getenv(envNotifySocket)
+	}
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: addr,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Ready tells systemd that service startup or reload is finished.
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+// Reloading tells systemd that service is reloading. That is, it is going to
+// hand off its descriptors to the new process.
+func (n *Notifier) Reloading() error {
+	return n.Notify("RELOADING=1")
+}
+
+// Stopping tells systemd that service is shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// MainPID tells systemd that the main process of the service is pid and that
+// the service is ready. It must be called when descriptors are handed off to
+// the new process, so systemd does not consider the service dead after the
+// old process exits.
+//
+// Note that systemd accepts notifications only from the main process by
+// default. That is, MainPID should be called by the old process. Otherwise
+// NotifyAccess=all must be set for the service.
+func (n *Notifier) MainPID(pid int) error {
+	return n.Notify("MAINPID="+strconv.Itoa(pid), "READY=1")
+}
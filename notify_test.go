@@ -0,0 +1,154 @@
+package graceful
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify creates unixgram socket standing in for systemd. Returned
+// function must be called to release it.
+func listenNotify(t *testing.T) (conn *net.UnixConn, addr string, release func()) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = filepath.Join(dir, "notify.sock")
+	conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{
+		Name: addr,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return conn, addr, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, 4096)
+	n, err := conn.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn, addr, release := listenNotify(t)
+	defer release()
+
+	n := Notifier{Addr: addr}
+	for _, test := range []struct {
+		name   string
+		notify func() error
+		exp    string
+	}{
+		{"ready", n.Ready, "READY=1"},
+		{"reloading", n.Reloading, "RELOADING=1"},
+		{"stopping", n.Stopping, "STOPPING=1"},
+		{"mainpid", func() error { return n.MainPID(42) }, "MAINPID=42\nREADY=1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.notify(); err != nil {
+				t.Fatal(err)
+			}
+			if act := readNotify(t, conn); act != test.exp {
+				t.Errorf("unexpected notification: %q; want %q", act, test.exp)
+			}
+		})
+	}
+}
+
+func TestNotifierNoSocket(t *testing.T) {
+	if prev, ok := os.LookupEnv(envNotifySocket); ok {
+		os.Unsetenv(envNotifySocket)
+		defer os.Setenv(envNotifySocket, prev)
+	}
+	var n Notifier
+	if err := n.Ready(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUpgraderNotify(t *testing.T) {
+	conn, addr, release := listenNotify(t)
+	defer release()
+
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var reg Registry
+	if err := reg.RegisterListener("http", ln); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		mode string
+		exp  func(pid int) []string
+	}{
+		{
+			name: "ready",
+			mode: "ready",
+			exp: func(pid int) []string {
+				return []string{
+					"RELOADING=1",
+					"MAINPID=" + strconv.Itoa(pid) + "\nREADY=1",
+				}
+			},
+		},
+		{
+			name: "fail",
+			mode: "fail",
+			exp: func(int) []string {
+				return []string{
+					"RELOADING=1",
+					"READY=1",
+				}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			u := Upgrader{
+				Registry: &reg,
+				Path:     os.Args[0],
+				Args:     []string{"-test.run=^TestUpgraderChild$"},
+				Env: append(
+					os.Environ(),
+					envUpgradeTest+"="+test.mode,
+					envUpgradeTestAddr+"="+ln.Addr().String(),
+				),
+				Stdout:       ioutil.Discard,
+				Stderr:       ioutil.Discard,
+				ReadyTimeout: 10 * time.Second,
+				Notifier:     &Notifier{Addr: addr},
+			}
+			var pid int
+			cmd, err := u.Upgrade(context.Background())
+			if cmd != nil {
+				pid = cmd.Process.Pid
+				cmd.Wait()
+			}
+			if (err == nil) != (test.mode == "ready") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, exp := range test.exp(pid) {
+				if act := readNotify(t, conn); act != exp {
+					t.Errorf("unexpected notification: %q; want %q", act, exp)
+				}
+			}
+		})
+	}
+}
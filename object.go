@@ -0,0 +1,112 @@
+package graceful
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Object represents a received descriptor converted to the object of its
+// kind.
+type Object struct {
+	// Name is a name of the object given by the server.
+	Name string
+
+	// Kind is a kind of the object.
+	Kind Kind
+
+	// Value is an object itself. Its type depends on Kind:
+	//
+	//   KindListener   – net.Listener;
+	//   KindConn       – net.Conn;
+	//   KindPacketConn – net.PacketConn;
+	//   KindUnixgram   – *net.UnixConn;
+	//   KindFile       – *os.File;
+	//   KindUnknown    – *os.File.
+	Value interface{}
+
+	// Meta contains decoded meta of the object. It is nil if the meta was not
+	// sent or could not be decoded as Meta.
+	Meta Meta
+}
+
+// Close closes underlying object.
+func (o Object) Close() error {
+	if c, ok := o.Value.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ReceiveObjects dials to the "unix" network address addr, requests
+// descriptors with given names and returns them converted to the objects of
+// their kinds. If no names are given, then all descriptors are requested.
+func ReceiveObjects(addr string, names ...string) ([]Object, error) {
+	c := Client{}
+	return c.ReceiveObjects(addr, names...)
+}
+
+// ReceiveObjects dials to the "unix" network address addr, requests
+// descriptors with given names and returns them converted to the objects of
+// their kinds. If no names are given, then all descriptors are requested.
+//
+// Note that servers that do not tag descriptors with kinds could be
+// received only as *os.File objects of KindUnknown.
+func (c *Client) ReceiveObjects(addr string, names ...string) ([]Object, error) {
+	ds, err := c.ReceiveDescriptors(addr, names...)
+	if err != nil {
+		return nil, err
+	}
+	return ds.Objects()
+}
+
+// Objects takes all descriptors from ds and converts them to the objects of
+// their kinds. If some descriptor could not be converted, then all
+// descriptors and objects are closed and error is returned.
+func (ds *Descriptors) Objects() ([]Object, error) {
+	ds.mu.Lock()
+	list := ds.list
+	ds.list = nil
+	ds.mu.Unlock()
+
+	objs := make([]Object, 0, len(list))
+	for i, d := range list {
+		obj, err := newObject(d)
+		if err != nil {
+			for _, obj := range objs {
+				obj.Close()
+			}
+			for _, d := range list[i+1:] {
+				syscall.Close(d.Fd)
+			}
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// newObject converts descriptor d to the object of its kind. Note that d.Fd
+// is closed if conversion fails.
+func newObject(d Descriptor) (obj Object, err error) {
+	obj = Object{
+		Name: d.Name,
+		Kind: d.Kind,
+		Meta: d.Meta,
+	}
+	switch d.Kind {
+	case KindListener:
+		obj.Value, err = FdListener(d.Fd)
+	case KindConn, KindUnixgram:
+		obj.Value, err = FdConn(d.Fd)
+	case KindPacketConn:
+		obj.Value, err = FdPacketConn(d.Fd)
+	default:
+		fname, _ := d.Meta[MetaAddr].(string)
+		obj.Value = os.NewFile(uintptr(d.Fd), fname)
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	return obj, nil
+}
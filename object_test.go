@@ -0,0 +1,96 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReceiveObjects(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ug, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ug.Close()
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		HandshakeTimeout: 10 * time.Millisecond,
+		Handler: SequenceHandler(
+			ListenerHandler(ln, nil),
+			PacketConnHandler(pc, nil),
+			PacketConnHandler(ug, nil),
+			FileHandler(f, nil),
+			FdHandler(int(f.Fd()), nil),
+		),
+	}
+	go server.Serve(gln)
+	defer server.Close()
+
+	objs, err := ReceiveObjects(gln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, obj := range objs {
+			obj.Close()
+		}
+	}()
+
+	exp := []Kind{
+		KindListener,
+		KindPacketConn,
+		KindUnixgram,
+		KindFile,
+		KindUnknown,
+	}
+	if act := len(objs); act != len(exp) {
+		t.Fatalf("received %d objects; want %d", act, len(exp))
+	}
+	for i, obj := range objs {
+		if obj.Kind != exp[i] {
+			t.Errorf("object #%d is a %s; want %s", i, obj.Kind, exp[i])
+		}
+		var ok bool
+		switch obj.Kind {
+		case KindListener:
+			var v net.Listener
+			v, ok = obj.Value.(net.Listener)
+			ok = ok && v.Addr().String() == ln.Addr().String()
+		case KindPacketConn:
+			var v net.PacketConn
+			v, ok = obj.Value.(net.PacketConn)
+			ok = ok && v.LocalAddr().String() == pc.LocalAddr().String()
+		case KindUnixgram:
+			var v *net.UnixConn
+			v, ok = obj.Value.(*net.UnixConn)
+			ok = ok && v.LocalAddr().String() == ug.LocalAddr().String()
+		default:
+			_, ok = obj.Value.(*os.File)
+		}
+		if !ok {
+			t.Errorf("unexpected object #%d value: %#v", i, obj.Value)
+		}
+	}
+}
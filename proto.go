@@ -0,0 +1,539 @@
+package graceful
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Errors used to describe protocol violations.
+var (
+	// ErrBadHello is returned when the peer sends malformed protocol
+	// preamble.
+	ErrBadHello = errors.New("malformed protocol preamble")
+
+	// ErrBadAck is returned when the client sends malformed
+	// acknowledgement.
+	ErrBadAck = errors.New("malformed acknowledgement")
+
+	// ErrBadRequest is returned when the client sends malformed request of
+	// descriptors.
+	ErrBadRequest = errors.New("malformed request")
+
+	// ErrBadFrame is returned when the peer sends frame header which
+	// announces the frame larger than the protocol allows.
+	ErrBadFrame = errors.New("malformed frame header")
+)
+
+// protoVersion is the version of the protocol implemented by this package.
+// Zero version is the legacy protocol which does not use any preamble or
+// frame headers.
+const protoVersion = 1
+
+// caps is a set of protocol capabilities.
+type caps uint32
+
+const (
+	// capFrameHeader means that frames are preceded by frame headers.
+	capFrameHeader caps = 1 << iota
+
+	// capAck means that server half-closes the connection after the last
+	// frame and client replies with acknowledgement.
+	capAck
+
+	// capNames means that client understands named frames, which entries
+	// carry flags, kinds and names.
+	capNames
+
+	// capRequest means that client sends names of descriptors it wants
+	// right after the preamble.
+	capRequest
+
+	// capReady means that client keeps the connection open after the
+	// acknowledgement and reports its readiness by one more
+	// acknowledgement.
+	capReady
+
+	// capProbe means that client only checks whether server is alive.
+	// Server closes the connection right after the preamble without
+	// sending any descriptors.
+	capProbe
+
+	// capState means that client understands state chunks sent between
+	// frames.
+	capState
+
+	// capChecksum means that client verifies frame trailers.
+	capChecksum
+)
+
+// supportedCaps is the set of capabilities implemented by this package.
+const supportedCaps = capFrameHeader | capAck | capNames | capRequest | capReady | capProbe | capState | capChecksum
+
+// optionalCaps is the set of capabilities that client sets only when it uses
+// them.
+const optionalCaps = capRequest | capReady | capProbe
+
+const handshakeDefaultTimeout = 100 * time.Millisecond
+
+var (
+	// helloMagic marks the beginning of a protocol preamble.
+	helloMagic = [4]byte{'G', 'R', 'F', 'V'}
+
+	// frameMagic marks the beginning of a frame header.
+	//
+	// Legacy servers start each frame with little-endian length of the first
+	// meta. Value of frameMagic read as such length is far beyond any
+	// reasonable buffer size, so it can not be confused with it.
+	frameMagic = [4]byte{'G', 'R', 'F', 'L'}
+
+	// ackMagic marks the beginning of an acknowledgement.
+	ackMagic = [4]byte{'G', 'R', 'F', 'A'}
+
+	// requestMagic marks the beginning of a request.
+	requestMagic = [4]byte{'G', 'R', 'F', 'Q'}
+)
+
+const (
+	helloSize         = 12
+	frameHeaderSize   = 16
+	ackHeaderSize     = 12
+	requestHeaderSize = 8
+)
+
+// Limits of the frame announced by a frame header. They are checked before
+// any buffer is allocated for the frame.
+const (
+	// maxFrameSize limits the number of meta bytes in a frame.
+	maxFrameSize = 16 << 20
+
+	// maxFrameFds limits the number of descriptors in a frame. It is the
+	// maximum number of descriptors passed by a single message on Linux
+	// (SCM_MAX_FD).
+	maxFrameFds = 253
+)
+
+// maxRequestSize limits the size of names sent within a request.
+const maxRequestSize = 64 << 10
+
+// maxAckReason limits the length of the reason sent within negative
+// acknowledgement.
+const maxAckReason = 4096
+
+// Acknowledgement codes.
+const (
+	ackOK   = 0
+	ackFail = 1
+)
+
+// hello is a protocol preamble. Client sends it right after dial and server
+// replies with negotiated version and capabilities.
+type hello struct {
+	version int
+	caps    caps
+}
+
+// has reports whether all capabilities c were negotiated.
+func (h hello) has(c caps) bool {
+	return h.caps&c == c
+}
+
+// negotiate returns hello with the highest version and capabilities that
+// are supported by both h and this package.
+func (h hello) negotiate() hello {
+	if h.version > protoVersion {
+		h.version = protoVersion
+	}
+	h.caps &= supportedCaps
+	return h
+}
+
+func (h hello) encode(p []byte) {
+	copy(p, helloMagic[:])
+	binary.LittleEndian.PutUint32(p[4:], uint32(h.version))
+	binary.LittleEndian.PutUint32(p[8:], uint32(h.caps))
+}
+
+func decodeHello(p []byte) (h hello, err error) {
+	if string(p[:4]) != string(helloMagic[:]) {
+		return h, ErrBadHello
+	}
+	h.version = int(binary.LittleEndian.Uint32(p[4:]))
+	h.caps = caps(binary.LittleEndian.Uint32(p[8:]))
+	if h.version == 0 {
+		return h, ErrBadHello
+	}
+	return h, nil
+}
+
+func writeHello(conn *net.UnixConn, h hello) error {
+	p := make([]byte, helloSize)
+	h.encode(p)
+	return writeFull(conn, p)
+}
+
+// Frame flags.
+const (
+	// frameNamed means that frame entries carry flags, kinds and names.
+	frameNamed = 1 << iota
+
+	// frameChecksum means that frame entries are followed by the trailer.
+	frameChecksum
+)
+
+// frameTrailerSize is the size of the frame trailer. Trailer holds 4 bytes of
+// little-endian CRC32 (IEEE) of the frame entries and 4 bytes of
+// little-endian number of descriptors in the frame.
+const frameTrailerSize = 8
+
+// appendFrameTrailer appends the trailer of the frame with entries msg and
+// fdn descriptors to msg.
+func appendFrameTrailer(msg []byte, fdn int) []byte {
+	var p [frameTrailerSize]byte
+	binary.LittleEndian.PutUint32(p[0:], crc32.ChecksumIEEE(msg))
+	binary.LittleEndian.PutUint32(p[4:], uint32(fdn))
+	return append(msg, p[:]...)
+}
+
+// checkFrameTrailer verifies the trailer of the frame msg that is announced
+// to carry fdn descriptors. It returns frame entries without the trailer.
+func checkFrameTrailer(msg []byte, fdn int) ([]byte, error) {
+	if len(msg) < frameTrailerSize {
+		return nil, &CorruptFrameError{
+			Offset: 0,
+			Reason: "frame is too short to carry the trailer",
+		}
+	}
+	var (
+		off = len(msg) - frameTrailerSize
+		sum = binary.LittleEndian.Uint32(msg[off:])
+		n   = int(binary.LittleEndian.Uint32(msg[off+4:]))
+	)
+	if act := crc32.ChecksumIEEE(msg[:off]); act != sum {
+		return nil, &CorruptFrameError{
+			Offset: off,
+			Reason: fmt.Sprintf("checksum is %08x; want %08x", act, sum),
+		}
+	}
+	if n != fdn {
+		return nil, &CorruptFrameError{
+			Offset: off + 4,
+			Reason: fmt.Sprintf("trailer holds %d descriptors; header announced %d", n, fdn),
+		}
+	}
+	return msg[:off], nil
+}
+
+// frameHeader is sent before each frame of descriptors. It announces sizes
+// of the frame so the client could prepare its buffers before reading the
+// frame.
+type frameHeader struct {
+	msgn  int    // Number of meta bytes in the frame.
+	fdn   int    // Number of descriptors in the frame.
+	flags uint32 // Format of the frame entries.
+}
+
+func (h frameHeader) encode(p []byte) {
+	copy(p, frameMagic[:])
+	binary.LittleEndian.PutUint32(p[4:], uint32(h.msgn))
+	binary.LittleEndian.PutUint32(p[8:], uint32(h.fdn))
+	binary.LittleEndian.PutUint32(p[12:], h.flags)
+}
+
+// decodeFrameHeader decodes frame header from p. It returns ErrBadFrame if
+// the frame is larger than maxFrameSize or holds more than maxFrameFds
+// descriptors.
+func decodeFrameHeader(p []byte) (h frameHeader, err error) {
+	var (
+		msgn = binary.LittleEndian.Uint32(p[4:])
+		fdn  = binary.LittleEndian.Uint32(p[8:])
+	)
+	if msgn > maxFrameSize || fdn > maxFrameFds {
+		return h, ErrBadFrame
+	}
+	h.msgn = int(msgn)
+	h.fdn = int(fdn)
+	h.flags = binary.LittleEndian.Uint32(p[12:])
+	return h, nil
+}
+
+// Entry flags.
+const (
+	// entryMissing means that entry has no descriptor because requested name
+	// was not found.
+	entryMissing = 1 << iota
+)
+
+// entry is a single descriptor record within a frame.
+//
+// Legacy entry is encoded as 4 bytes of little-endian meta length followed by
+// meta bytes. Named entry is prefixed by a byte of flags, a byte of kind, 2
+// bytes of little-endian name length and name bytes.
+type entry struct {
+	fd    int
+	name  string
+	kind  Kind
+	flags byte
+	meta  []byte // Meta bytes of a parsed entry.
+}
+
+func (e entry) hasFd() bool {
+	return e.flags&entryMissing == 0
+}
+
+func (e entry) headerSize(named bool) int {
+	if !named {
+		return msgHeaderSize
+	}
+	return 4 + len(e.name) + msgHeaderSize
+}
+
+// putHeader encodes e's header into p and returns number of bytes written.
+func (e entry) putHeader(p []byte, named bool, metaLen int) int {
+	var n int
+	if named {
+		p[0] = e.flags
+		p[1] = byte(e.kind)
+		binary.LittleEndian.PutUint16(p[2:], uint16(len(e.name)))
+		n = 4 + copy(p[4:], e.name)
+	}
+	binary.LittleEndian.PutUint32(p[n:], uint32(metaLen))
+	return n + msgHeaderSize
+}
+
+// parseEntries parses frame entries from msg. It returns the offset of the
+// first byte that was not parsed. That is, offset is less than len(msg) if
+// msg ends with incomplete entry.
+func parseEntries(msg []byte, named bool) (es []entry, off int) {
+	for off < len(msg) {
+		var (
+			e entry
+			p = msg[off:]
+		)
+		if named {
+			if len(p) < 4 {
+				return es, off
+			}
+			e.flags = p[0]
+			e.kind = Kind(p[1])
+			n := int(binary.LittleEndian.Uint16(p[2:]))
+			p = p[4:]
+			if len(p) < n {
+				return es, off
+			}
+			e.name = string(p[:n])
+			p = p[n:]
+		}
+		if len(p) < msgHeaderSize {
+			return es, off
+		}
+		m := binary.LittleEndian.Uint32(p)
+		p = p[msgHeaderSize:]
+		if uint64(m) > uint64(len(p)) {
+			return es, off
+		}
+		e.meta = p[:m]
+		off = len(msg) - len(p) + int(m)
+		es = append(es, e)
+	}
+	return es, off
+}
+
+// countFds returns number of entries that carry descriptors.
+func countFds(es []entry) (n int) {
+	for _, e := range es {
+		if e.hasFd() {
+			n++
+		}
+	}
+	return n
+}
+
+// writeRequest writes request of descriptors with given names to conn.
+func writeRequest(conn *net.UnixConn, names []string) error {
+	size := 0
+	for _, name := range names {
+		if len(name) > 0xffff {
+			return ErrLongWrite
+		}
+		size += 2 + len(name)
+	}
+	if size > maxRequestSize {
+		return ErrLongWrite
+	}
+	p := make([]byte, requestHeaderSize+size)
+	copy(p, requestMagic[:])
+	binary.LittleEndian.PutUint32(p[4:], uint32(size))
+	n := requestHeaderSize
+	for _, name := range names {
+		binary.LittleEndian.PutUint16(p[n:], uint16(len(name)))
+		n += 2 + copy(p[n+2:], name)
+	}
+	return writeFull(conn, p)
+}
+
+// readRequest reads names of requested descriptors from r.
+func readRequest(r io.Reader) ([]string, error) {
+	p := make([]byte, requestHeaderSize)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	if string(p[:4]) != string(requestMagic[:]) {
+		return nil, ErrBadRequest
+	}
+	size := binary.LittleEndian.Uint32(p[4:])
+	if size > maxRequestSize {
+		return nil, ErrBadRequest
+	}
+	p = make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for len(p) > 0 {
+		if len(p) < 2 {
+			return nil, ErrBadRequest
+		}
+		n := int(binary.LittleEndian.Uint16(p))
+		p = p[2:]
+		if len(p) < n {
+			return nil, ErrBadRequest
+		}
+		names = append(names, string(p[:n]))
+		p = p[n:]
+	}
+	return names, nil
+}
+
+func writeFrameHeader(conn *net.UnixConn, h frameHeader) error {
+	p := make([]byte, frameHeaderSize)
+	h.encode(p)
+	return writeFull(conn, p)
+}
+
+// writeAck writes acknowledgement to conn. If reason is non-nil, then the
+// acknowledgement is negative.
+func writeAck(conn *net.UnixConn, reason error) error {
+	var msg string
+	if reason != nil {
+		msg = reason.Error()
+		if len(msg) > maxAckReason {
+			msg = msg[:maxAckReason]
+		}
+	}
+	p := make([]byte, ackHeaderSize+len(msg))
+	copy(p, ackMagic[:])
+	code := ackOK
+	if reason != nil {
+		code = ackFail
+	}
+	binary.LittleEndian.PutUint32(p[4:], uint32(code))
+	binary.LittleEndian.PutUint32(p[8:], uint32(len(msg)))
+	copy(p[ackHeaderSize:], msg)
+	return writeFull(conn, p)
+}
+
+// readAck reads acknowledgement from r. It returns nil if acknowledgement is
+// positive and *NackError if it is negative.
+func readAck(r io.Reader) error {
+	p := make([]byte, ackHeaderSize)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return err
+	}
+	if string(p[:4]) != string(ackMagic[:]) {
+		return ErrBadAck
+	}
+	var (
+		code = binary.LittleEndian.Uint32(p[4:])
+		n    = binary.LittleEndian.Uint32(p[8:])
+	)
+	if n > maxAckReason {
+		return ErrBadAck
+	}
+	reason := make([]byte, n)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return err
+	}
+	switch code {
+	case ackOK:
+		return nil
+	case ackFail:
+		return &NackError{Reason: string(reason)}
+	default:
+		return ErrBadAck
+	}
+}
+
+func writeFull(conn *net.UnixConn, p []byte) error {
+	n, err := conn.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// readMagic returns magic of the next message in conn. Nothing is read from
+// the conn; if the next message has no known magic, zero value is returned.
+func readMagic(conn *net.UnixConn) (magic [4]byte, err error) {
+	var p [4]byte
+	n, err := peek(conn, p[:])
+	if err != nil {
+		return magic, err
+	}
+	if n == len(p) && (p == helloMagic || p == frameMagic || p == stateMagic) {
+		magic = p
+	}
+	return magic, nil
+}
+
+// peekProbe reports whether the probe preamble is already received from conn.
+// It does not wait for the data to arrive.
+func peekProbe(conn *net.UnixConn) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var (
+		p = make([]byte, helloSize)
+		n int
+	)
+	cerr := rc.Control(func(fd uintptr) {
+		n, _, err = syscall.Recvfrom(int(fd), p, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	})
+	if cerr != nil || err != nil || n < helloSize {
+		return false
+	}
+	h, err := decodeHello(p)
+	return err == nil && h.has(capProbe)
+}
+
+// peek reads up to len(p) bytes from conn without removing them from the
+// socket receive queue.
+//
+// Note that control messages are not received by peek.
+func peek(conn *net.UnixConn, p []byte) (n int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	rerr := rc.Read(func(fd uintptr) bool {
+		n, _, err = syscall.Recvfrom(int(fd), p, syscall.MSG_PEEK)
+		return err != syscall.EAGAIN
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		return 0, os.NewSyscallError("recvfrom", err)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
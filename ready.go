@@ -0,0 +1,61 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+)
+
+// ready holds connections to the servers waiting for readiness report.
+var ready struct {
+	mu    sync.Mutex
+	conns []readyConn
+}
+
+// readyConn is a connection waiting for readiness report. If lock is not nil,
+// it is released after the report.
+type readyConn struct {
+	conn *net.UnixConn
+	lock *HandoffLock
+}
+
+func keepReady(conn *net.UnixConn, lock *HandoffLock) {
+	ready.mu.Lock()
+	defer ready.mu.Unlock()
+	ready.conns = append(ready.conns, readyConn{conn, lock})
+}
+
+// Ready reports to the previous application instance that the process has
+// received its descriptors and is now serving them. Then the previous instance
+// could stop serving shared objects.
+//
+// Readiness is reported to the Upgrader of the parent process (see
+// UpgradeReady()) and to the servers from which descriptors were received by
+// a Client with NotifyReady set. It is a no-op if there are none of them.
+func Ready() error {
+	return notifyReady(nil)
+}
+
+// NotReady is like Ready(), but it reports that the process failed to start
+// serving received descriptors for the given reason. Then the previous
+// instance should keep serving shared objects.
+func NotReady(reason error) error {
+	return notifyReady(reason)
+}
+
+func notifyReady(reason error) error {
+	ready.mu.Lock()
+	conns := ready.conns
+	ready.conns = nil
+	ready.mu.Unlock()
+
+	for _, rc := range conns {
+		// Error is not checked here cause server is free to close the
+		// connection without waiting for readiness.
+		writeAck(rc.conn, reason)
+		rc.conn.Close()
+		if rc.lock != nil {
+			rc.lock.Unlock()
+		}
+	}
+	return UpgradeReady(reason)
+}
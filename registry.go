@@ -0,0 +1,388 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Errors used by the Registry and Descriptors.
+var (
+	// ErrRegistered is returned by the Registry when some object is already
+	// registered under the same name.
+	ErrRegistered = errors.New("name is already registered")
+
+	// ErrNotFound is returned by the Descriptors when there is no descriptor
+	// with given name.
+	ErrNotFound = errors.New("descriptor not found")
+)
+
+// Meta keys used by the Registry to describe sent objects.
+const (
+	MetaName    = "name"
+	MetaKind    = "kind"
+	MetaNetwork = "network"
+	MetaAddr    = "addr"
+)
+
+// Registry contains objects registered by names that need to be shared with
+// the next application instance. It is safe for concurrent use.
+//
+// Registry implements Handler. Each registered object is sent with Meta that
+// carries its name, kind and address (or file name). If client requested
+// particular names, only those objects are sent. Client could use
+// ReceiveDescriptors() to rebuild the objects.
+type Registry struct {
+	// MetaCodec is an optional codec used to encode Meta of the objects.
+	// If MetaCodec is nil, then GobCodec is used.
+	MetaCodec MetaCodec
+
+	mu      sync.RWMutex
+	names   []string
+	entries map[string]registryEntry
+}
+
+type registryEntry struct {
+	kind  Kind
+	value interface{}
+	meta  Meta
+}
+
+// RegisterListener registers ln under the given name.
+func (r *Registry) RegisterListener(name string, ln net.Listener) error {
+	return r.register(name, KindListener, ln, ln.Addr())
+}
+
+// RegisterConn registers conn under the given name.
+func (r *Registry) RegisterConn(name string, conn net.Conn) error {
+	return r.register(name, KindConn, conn, conn.LocalAddr())
+}
+
+// RegisterPacketConn registers conn under the given name.
+func (r *Registry) RegisterPacketConn(name string, conn net.PacketConn) error {
+	return r.register(name, KindPacketConn, conn, conn.LocalAddr())
+}
+
+// RegisterFile registers file under the given name.
+func (r *Registry) RegisterFile(name string, file *os.File) error {
+	return r.register(name, KindFile, file, nil)
+}
+
+// Unregister removes object registered under the given name. It is a no-op
+// if there is no such object. Objects must be unregistered before they are
+// closed.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; !ok {
+		return
+	}
+	delete(r.entries, name)
+	for i, n := range r.names {
+		if n == name {
+			r.names = append(r.names[:i], r.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns names of all registered objects in order of registration.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+// Handle sends registered objects to the client.
+func (r *Registry) Handle(conn net.Conn, resp ResponseWriter) {
+	names := Requested(resp)
+	if names == nil {
+		names = r.Names()
+	}
+	for _, name := range names {
+		r.mu.RLock()
+		e, ok := r.entries[name]
+		r.mu.RUnlock()
+		if !ok {
+			writeMissing(resp, name)
+			continue
+		}
+		var (
+			rw   = namedResponse{resp, name}
+			meta = e.meta.WithCodec(r.MetaCodec)
+			err  error
+		)
+		// Switch on the kind cause some values (such as *net.UDPConn)
+		// implement several interfaces.
+		switch e.kind {
+		case KindListener:
+			err = SendListener(rw, e.value.(net.Listener), meta)
+		case KindConn:
+			err = SendConn(rw, e.value.(net.Conn), meta)
+		case KindPacketConn:
+			err = SendPacketConn(rw, e.value.(net.PacketConn), meta)
+		case KindFile:
+			err = SendFile(rw, e.value.(*os.File), meta)
+		}
+		if err != nil {
+			resp.Errorf("send %s %q error: %v", e.kind, name, err)
+		}
+	}
+}
+
+func (r *Registry) register(name string, kind Kind, v interface{}, addr net.Addr) error {
+	meta := Meta{
+		MetaName: name,
+		MetaKind: addrKind(kind, addr).String(),
+	}
+	if addr != nil {
+		meta[MetaNetwork] = addr.Network()
+		meta[MetaAddr] = addr.String()
+	}
+	if f, ok := v.(*os.File); ok {
+		meta[MetaAddr] = f.Name()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exist := r.entries[name]; exist {
+		return ErrRegistered
+	}
+	if r.entries == nil {
+		r.entries = make(map[string]registryEntry)
+	}
+	r.entries[name] = registryEntry{
+		kind:  kind,
+		value: v,
+		meta:  meta,
+	}
+	r.names = append(r.names, name)
+	return nil
+}
+
+// Descriptor represents a received descriptor.
+type Descriptor struct {
+	// Name is a name of the descriptor given by the server.
+	Name string
+
+	// Kind is a kind of the object which descriptor was sent.
+	Kind Kind
+
+	// Fd is a descriptor itself.
+	Fd int
+
+	// Meta contains decoded meta of the descriptor. It is nil if the meta
+	// was not sent or could not be decoded as Meta.
+	Meta Meta
+}
+
+// Descriptors is a set of received descriptors that allows to rebuild
+// objects by their names.
+//
+// Each descriptor could be taken only once by one of the Listener(), Conn(),
+// PacketConn() or File() methods. It is safe for concurrent use.
+type Descriptors struct {
+	mu   sync.Mutex
+	list []Descriptor
+}
+
+// ReceiveDescriptors dials to the "unix" network address addr, requests
+// descriptors with given names and returns them. If no names are given,
+// then all descriptors are requested.
+func ReceiveDescriptors(addr string, names ...string) (*Descriptors, error) {
+	c := Client{}
+	return c.ReceiveDescriptors(addr, names...)
+}
+
+// ReceiveDescriptors dials to the "unix" network address addr, requests
+// descriptors with given names and returns them. If no names are given,
+// then all descriptors are requested.
+func (c *Client) ReceiveDescriptors(addr string, names ...string) (*Descriptors, error) {
+	ds := new(Descriptors)
+	if err := c.receiveNamed(context.Background(), addr, names, ds.add); err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Inherit returns descriptors passed to the process by systemd or by the
+// Upgrader of the parent process. If there are no such descriptors, then it
+// calls ReceiveDescriptors(addr, names...). That is, it allows an application
+// to have a single startup path regardless of where its descriptors come
+// from.
+func Inherit(addr string, names ...string) (*Descriptors, error) {
+	c := Client{}
+	return c.Inherit(addr, names...)
+}
+
+// Inherit returns descriptors passed to the process by systemd or by the
+// Upgrader of the parent process. If there are no such descriptors, then it
+// calls c.ReceiveDescriptors(addr, names...).
+//
+// Note that all inherited descriptors are returned regardless of names.
+func (c *Client) Inherit(addr string, names ...string) (*Descriptors, error) {
+	for _, inherited := range []func(bool) (*Descriptors, error){
+		ListenFds,
+		UpgradeFds,
+	} {
+		ds, err := inherited(true)
+		if err != nil {
+			return nil, err
+		}
+		if len(ds.All()) > 0 {
+			return ds, nil
+		}
+	}
+	return c.ReceiveDescriptors(addr, names...)
+}
+
+// Add is a NamedReceiveCallback that adds received descriptor to ds.
+//
+// If name is empty, then the name is taken from the meta. Missing
+// descriptors are ignored.
+func (ds *Descriptors) Add(name string, fd int, meta io.Reader) error {
+	return ds.add(entry{fd: fd, name: name}, meta)
+}
+
+// add adds received entry to ds. Kind of the entry sent by the server takes
+// precedence over the kind from the meta.
+func (ds *Descriptors) add(e entry, meta io.Reader) error {
+	if e.fd < 0 {
+		return nil
+	}
+	d := Descriptor{
+		Name: e.name,
+		Kind: e.kind,
+		Fd:   e.fd,
+	}
+	if meta != nil {
+		if m, err := MetaFrom(meta); err == nil {
+			d.Meta = m
+		}
+	}
+	if s, ok := d.Meta[MetaName].(string); ok && d.Name == "" {
+		d.Name = s
+	}
+	if s, ok := d.Meta[MetaKind].(string); ok && d.Kind == KindUnknown {
+		d.Kind = ParseKind(s)
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.list = append(ds.list, d)
+	return nil
+}
+
+// All returns all descriptors that are not taken yet.
+func (ds *Descriptors) All() []Descriptor {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return append([]Descriptor(nil), ds.list...)
+}
+
+// Get returns descriptor with given name. It returns false if there is no
+// such descriptor.
+func (ds *Descriptors) Get(name string) (Descriptor, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i := ds.index(name)
+	if i == -1 {
+		return Descriptor{}, false
+	}
+	return ds.list[i], true
+}
+
+// Listener takes descriptor with given name and converts it to the
+// net.Listener.
+func (ds *Descriptors) Listener(name string) (ln net.Listener, err error) {
+	err = ds.take(name, []Kind{KindListener}, nil, func(d Descriptor) (err error) {
+		ln, err = FdListener(d.Fd)
+		return err
+	})
+	return ln, err
+}
+
+// Conn takes descriptor with given name and converts it to the net.Conn.
+func (ds *Descriptors) Conn(name string) (conn net.Conn, err error) {
+	err = ds.take(name, []Kind{KindConn, KindUnixgram}, nil, func(d Descriptor) (err error) {
+		conn, err = FdConn(d.Fd)
+		return err
+	})
+	return conn, err
+}
+
+// PacketConn takes descriptor with given name and converts it to the
+// net.PacketConn.
+func (ds *Descriptors) PacketConn(name string) (conn net.PacketConn, err error) {
+	err = ds.take(name, []Kind{KindPacketConn, KindUnixgram}, nil, func(d Descriptor) (err error) {
+		conn, err = FdPacketConn(d.Fd)
+		return err
+	})
+	return conn, err
+}
+
+// File takes descriptor with given name and converts it to the *os.File.
+func (ds *Descriptors) File(name string) (file *os.File, err error) {
+	err = ds.take(name, []Kind{KindFile}, nil, func(d Descriptor) error {
+		fname, _ := d.Meta[MetaAddr].(string)
+		file = os.NewFile(uintptr(d.Fd), fname)
+		return nil
+	})
+	return file, err
+}
+
+// Close closes all descriptors that are not taken yet.
+func (ds *Descriptors) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var err error
+	for _, d := range ds.list {
+		if cerr := syscall.Close(d.Fd); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	ds.list = nil
+	return err
+}
+
+// take calls fn with descriptor with given name and removes it from ds. If
+// descriptor is of known kind other than the given ones, or check is non-nil
+// and returns error, then the error is returned and descriptor is left in ds.
+//
+// Descriptor is removed from ds even if fn fails, since fn owns it and must
+// close it in that case. Otherwise the later Close() could close descriptor
+// number that is already reused by an unrelated file.
+func (ds *Descriptors) take(name string, kinds []Kind, check, fn func(Descriptor) error) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i := ds.index(name)
+	if i == -1 {
+		return ErrNotFound
+	}
+	d := ds.list[i]
+	if !d.Kind.oneOf(kinds) {
+		return fmt.Errorf("descriptor %q is a %s, not a %s", name, d.Kind, kinds[0])
+	}
+	if check != nil {
+		if err := check(d); err != nil {
+			return err
+		}
+	}
+	ds.list = append(ds.list[:i], ds.list[i+1:]...)
+	return fn(d)
+}
+
+func (ds *Descriptors) index(name string) int {
+	for i, d := range ds.list {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
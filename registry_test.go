@@ -0,0 +1,160 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var reg Registry
+	if err := reg.RegisterListener("http", ln); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RegisterPacketConn("dns", pc); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RegisterFile("log", f); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RegisterFile("log", f); err != ErrRegistered {
+		t.Errorf("unexpected duplicate registration error: %v; want %v", err, ErrRegistered)
+	}
+	if err := reg.RegisterListener("admin", ln); err != nil {
+		t.Fatal(err)
+	}
+	reg.Unregister("admin")
+
+	gln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		HandshakeTimeout: 10 * time.Millisecond,
+		Handler:          &reg,
+	}
+	go server.Serve(gln)
+	defer server.Close()
+
+	ds, err := ReceiveDescriptors(gln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	if act, exp := len(ds.All()), 3; act != exp {
+		t.Errorf("received %d descriptors; want %d", act, exp)
+	}
+	if _, ok := ds.Get("admin"); ok {
+		t.Errorf("unregistered descriptor was received")
+	}
+	if d, ok := ds.Get("dns"); !ok {
+		t.Errorf("descriptor %q was not received", "dns")
+	} else if d.Kind != KindPacketConn || d.Meta[MetaAddr] != pc.LocalAddr().String() {
+		t.Errorf("unexpected descriptor %q: kind %s, meta %v", d.Name, d.Kind, d.Meta)
+	}
+
+	if _, err := ds.Listener("dns"); err == nil {
+		t.Errorf("expected error taking packet conn as listener")
+	}
+	rln, err := ds.Listener("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rln.Close()
+	if act, exp := rln.Addr().String(), ln.Addr().String(); act != exp {
+		t.Errorf("unexpected listener address: %s; want %s", act, exp)
+	}
+	if _, err := ds.Listener("http"); err != ErrNotFound {
+		t.Errorf("unexpected error taking listener twice: %v; want %v", err, ErrNotFound)
+	}
+	rpc, err := ds.PacketConn("dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Close()
+	if act, exp := rpc.LocalAddr().String(), pc.LocalAddr().String(); act != exp {
+		t.Errorf("unexpected packet conn address: %s; want %s", act, exp)
+	}
+	rf, err := ds.File("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if act, exp := rf.Name(), f.Name(); act != exp {
+		t.Errorf("unexpected file name: %s; want %s", act, exp)
+	}
+	same, err := sameFile(int(rf.Fd()), int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same {
+		t.Errorf("received file is not the same")
+	}
+
+	sub, err := ReceiveDescriptors(gln.Addr().String(), "log", "nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if all := sub.All(); len(all) != 1 || all[0].Name != "log" {
+		t.Errorf("unexpected descriptors received by name: %+v", all)
+	}
+}
+
+func TestDescriptorsTakeError(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ds Descriptors
+	if err := ds.Add("x", fd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Listener("x"); err == nil {
+		t.Fatalf("expected error taking file as listener")
+	}
+	if _, ok := ds.Get("x"); ok {
+		t.Errorf("descriptor is left after failed conversion")
+	}
+
+	// Descriptor number is likely to be reused here.
+	g, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err := ds.Close(); err != nil {
+		t.Fatalf("unexpected Close() error: %v", err)
+	}
+	if _, err := g.Stat(); err != nil {
+		t.Errorf("unrelated file was closed: %v", err)
+	}
+}
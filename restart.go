@@ -0,0 +1,228 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// AbortError describes why restart was aborted. Err is the error returned by
+// the Upgrader, such as *NackError, ErrChildExited or
+// context.DeadlineExceeded.
+type AbortError struct {
+	// Signal is the signal which triggered the restart.
+	Signal os.Signal
+
+	// Err is the reason of abort.
+	Err error
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("restart on %v aborted: %v", e.Signal, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *AbortError) Unwrap() error { return e.Err }
+
+// Orchestrator restarts the application on signals.
+//
+// On restart signal it starts the new process by the Upgrader, which passes
+// registered descriptors to it and waits for its readiness. If the new
+// process is ready, Orchestrator calls drain hooks and stops. Otherwise the
+// restart is aborted and the current process keeps serving.
+//
+// On stop signal Orchestrator calls drain hooks and stops. Stop signal that
+// is received while the new process is starting aborts the restart.
+type Orchestrator struct {
+	// Upgrader is used to start the new process.
+	Upgrader *Upgrader
+
+	// RestartSignals is a list of signals that trigger restart.
+	// If RestartSignals is nil, then SIGHUP and SIGUSR2 are used.
+	RestartSignals []os.Signal
+
+	// StopSignals is a list of signals that trigger stop without restart.
+	// If StopSignals is nil, then SIGINT and SIGTERM are used.
+	StopSignals []os.Signal
+
+	// Drain is a list of hooks that are called in order before Orchestrator
+	// stops. Hooks should stop accepting on shared objects and wait for
+	// in-flight work to complete, like http.Server.Shutdown() does.
+	Drain []func(context.Context) error
+
+	// DrainTimeout limits the time given to the drain hooks.
+	// If DrainTimeout is zero, then no limit is used.
+	DrainTimeout time.Duration
+
+	// OnAbort is an optional function that is called when restart is
+	// aborted.
+	OnAbort func(*AbortError)
+
+	// Logger contains optional implementation of any *Logger interfaces
+	// provided by this package.
+	// If Logger is nil, then no logging is made.
+	Logger interface{}
+}
+
+// Run waits for signals and handles them as described above. It returns nil
+// when the process is restarted or stopped and all drain hooks succeed. If
+// ctx is done, then Run calls drain hooks and returns ctx.Err().
+func (o *Orchestrator) Run(ctx context.Context) error {
+	var (
+		restart = o.RestartSignals
+		stop    = o.StopSignals
+	)
+	if restart == nil {
+		restart = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
+	}
+	if stop == nil {
+		stop = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append(append([]os.Signal(nil), restart...), stop...)...)
+	defer signal.Stop(sig)
+	testHookNotify()
+
+	for {
+		var s os.Signal
+		select {
+		case <-ctx.Done():
+			if err := o.drain(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case s = <-sig:
+		}
+		if hasSignal(stop, s) {
+			o.infof("stopping on %v", s)
+			if err := o.notifyStopping(); err != nil {
+				o.errorf("notify stopping error: %v", err)
+			}
+			return o.drain()
+		}
+
+		o.infof("restarting on %v", s)
+		cmd, stopped, err := o.upgrade(ctx, sig, stop)
+		if cmd == nil {
+			o.abort(&AbortError{
+				Signal: s,
+				Err:    err,
+			})
+			if stopped == nil {
+				continue
+			}
+			o.infof("stopping on %v", stopped)
+			if err := o.notifyStopping(); err != nil {
+				o.errorf("notify stopping error: %v", err)
+			}
+			return o.drain()
+		}
+		if err != nil {
+			o.errorf("notify new main process error: %v", err)
+		}
+		o.infof("restarted as process %d", cmd.Process.Pid)
+		return o.drain()
+	}
+}
+
+// upgrade starts the new process by the Upgrader. It keeps receiving signals
+// from sig meanwhile: stop signal cancels the upgrade and is returned as
+// stopped, other signals are ignored. Thus the process is stoppable even if
+// the new process hangs.
+func (o *Orchestrator) upgrade(ctx context.Context, sig <-chan os.Signal, stop []os.Signal) (cmd *exec.Cmd, stopped os.Signal, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd, err = o.Upgrader.Upgrade(ctx)
+	}()
+	for {
+		select {
+		case <-done:
+			return cmd, stopped, err
+		case s := <-sig:
+			if !hasSignal(stop, s) {
+				o.infof("ignoring %v: restart is in progress", s)
+				continue
+			}
+			if stopped == nil {
+				stopped = s
+				cancel()
+			}
+		}
+	}
+}
+
+// RunAndExit calls o.Run(ctx) and then exits the process with zero status if
+// it returns nil and with non-zero status otherwise.
+func (o *Orchestrator) RunAndExit(ctx context.Context) {
+	if err := o.Run(ctx); err != nil {
+		o.errorf("exiting with error: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func (o *Orchestrator) notifyStopping() error {
+	if o.Upgrader == nil || o.Upgrader.Notifier == nil {
+		return nil
+	}
+	return o.Upgrader.Notifier.Stopping()
+}
+
+func (o *Orchestrator) abort(err *AbortError) {
+	o.errorf("%v", err)
+	if o.OnAbort != nil {
+		o.OnAbort(err)
+	}
+}
+
+// drain calls drain hooks in order. It returns the first error, but calls all
+// hooks anyway.
+func (o *Orchestrator) drain() (err error) {
+	ctx := context.Background()
+	if o.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.DrainTimeout)
+		defer cancel()
+	}
+	for i, fn := range o.Drain {
+		if derr := fn(ctx); derr != nil {
+			o.errorf("drain hook #%d error: %v", i, derr)
+			if err == nil {
+				err = derr
+			}
+		}
+	}
+	return err
+}
+
+func (o *Orchestrator) infof(f string, args ...interface{}) {
+	if l, ok := o.Logger.(InfoLogger); ok {
+		l.Infof(f, args...)
+	}
+}
+
+func (o *Orchestrator) errorf(f string, args ...interface{}) {
+	if l, ok := o.Logger.(ErrorLogger); ok {
+		l.Errorf(f, args...)
+	}
+}
+
+// testHookNotify is called by Run() after it subscribes to signals.
+var testHookNotify = func() {}
+
+func hasSignal(ss []os.Signal, s os.Signal) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
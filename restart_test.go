@@ -0,0 +1,154 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOrchestrator(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var reg Registry
+	if err := reg.RegisterListener("http", ln); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		mode    string
+		signals []os.Signal
+		wait    string // Log message to wait for before the next signal.
+		abort   error
+	}{
+		{
+			name:    "restart",
+			mode:    "ready",
+			signals: []os.Signal{syscall.SIGUSR2},
+		},
+		{
+			name:    "abort",
+			mode:    "fail",
+			signals: []os.Signal{syscall.SIGUSR2, syscall.SIGUSR1},
+			wait:    "aborted",
+			abort:   &NackError{Reason: "child failure"},
+		},
+		{
+			name:    "stop while restarting",
+			mode:    "hang",
+			signals: []os.Signal{syscall.SIGUSR2, syscall.SIGUSR1},
+			wait:    "restarting",
+			abort:   context.Canceled,
+		},
+		{
+			name:    "stop",
+			signals: []os.Signal{syscall.SIGUSR1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				drained int
+				aborted = make(chan *AbortError, 1)
+				logs    = make(chan string, 16)
+			)
+			logf := func(f string, args ...interface{}) {
+				select {
+				case logs <- fmt.Sprintf(f, args...):
+				default:
+				}
+			}
+			o := Orchestrator{
+				Upgrader: &Upgrader{
+					Registry: &reg,
+					Path:     os.Args[0],
+					Args:     []string{"-test.run=^TestUpgraderChild$"},
+					Env: append(
+						os.Environ(),
+						envUpgradeTest+"="+test.mode,
+						envUpgradeTestAddr+"="+ln.Addr().String(),
+					),
+					Stdout: ioutil.Discard,
+					Stderr: ioutil.Discard,
+				},
+				RestartSignals: []os.Signal{syscall.SIGUSR2},
+				StopSignals:    []os.Signal{syscall.SIGUSR1},
+				Drain: []func(context.Context) error{
+					func(context.Context) error {
+						drained++
+						return nil
+					},
+				},
+				OnAbort: func(err *AbortError) {
+					aborted <- err
+				},
+				Logger: LoggerFunc(nil, logf, logf),
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Signals must not be sent before Run() subscribes to them.
+			// Otherwise the default action kills the test process.
+			notified := make(chan struct{})
+			testHookNotify = func() { close(notified) }
+			defer func() { testHookNotify = func() {} }()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- o.Run(ctx)
+			}()
+			select {
+			case <-notified:
+			case <-ctx.Done():
+				t.Fatalf("Run() did not subscribe to signals")
+			}
+			for i, s := range test.signals {
+				if i > 0 {
+					waitLog(t, ctx, logs, test.wait)
+				}
+				syscall.Kill(os.Getpid(), s.(syscall.Signal))
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Run() error: %v", err)
+			}
+			if drained != 1 {
+				t.Errorf("drain hook was called %d times; want 1", drained)
+			}
+			var err *AbortError
+			select {
+			case err = <-aborted:
+			default:
+			}
+			switch {
+			case test.abort == nil && err != nil:
+				t.Errorf("unexpected abort: %v", err)
+			case test.abort != nil && err == nil:
+				t.Errorf("restart was not aborted")
+			case err != nil && (err.Signal != syscall.SIGUSR2 || err.Err.Error() != test.abort.Error()):
+				t.Errorf("unexpected abort error: %v; want %v", err, test.abort)
+			}
+		})
+	}
+}
+
+// waitLog waits for the log message that contains substring sub.
+func waitLog(t *testing.T, ctx context.Context, logs <-chan string, sub string) {
+	for {
+		select {
+		case msg := <-logs:
+			if strings.Contains(msg, sub) {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatalf("no log message with %q", sub)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DialError is returned by a Client with retry policy when it failed to
+// connect to the server.
+type DialError struct {
+	// Attempts is a number of dial attempts made.
+	Attempts int
+
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial failed after %d attempt(s): %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *DialError) Unwrap() error { return e.Err }
+
+// RetryPolicy describes how a Client retries to connect to the server.
+//
+// The delay before the n-th retry is Backoff * 2^(n-1), but not greater than
+// MaxBackoff if it is set. Then the delay is randomized by Jitter.
+type RetryPolicy struct {
+	// Attempts is the maximum number of dial attempts, including the first
+	// one. If Attempts is less than 2, then dial is not retried.
+	Attempts int
+
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+
+	// MaxBackoff limits the delay between attempts.
+	// If MaxBackoff is zero, then delay is not limited.
+	MaxBackoff time.Duration
+
+	// Jitter is a fraction of the delay by which the delay is randomly
+	// reduced or increased. That is, Jitter of 0.1 gives the delay from 90%
+	// to 110% of its value. Jitter must be in range [0, 1].
+	Jitter float64
+
+	// Retryable reports whether the dial error err is worth retrying.
+	// If Retryable is nil, then IsRetryable is used.
+	Retryable func(err error) bool
+}
+
+// IsRetryable reports whether err is a temporary dial error. It returns true
+// for errors that happen when the server is re-creating its socket, such as
+// ECONNREFUSED and ENOENT, and when server's accept queue is full.
+func IsRetryable(err error) bool {
+	switch underlyingError(err) {
+	case syscall.ECONNREFUSED, syscall.ENOENT, syscall.EAGAIN:
+		return true
+	}
+	return isTimeout(err)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns the delay before the n-th retry.
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// dialRetry dials to the addr by given function and retries it by the policy
+// p. Each attempt is limited by timeout, if it is non-zero. Errors are
+// converted by timeoutError() with ErrNoServer reason.
+//
+// If p is nil, then dialRetry does not retry and does not wrap errors into
+// *DialError.
+func dialRetry(ctx context.Context, p *RetryPolicy, timeout time.Duration, addr string) (*net.UnixConn, error) {
+	for n := 1; ; n++ {
+		conn, err := dialTimeout(ctx, timeout, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if p == nil {
+			return nil, err
+		}
+		if n >= p.Attempts || ctx.Err() != nil || !p.retryable(err) {
+			return nil, &DialError{Attempts: n, Err: err}
+		}
+		t := time.NewTimer(p.delay(n))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, &DialError{
+				Attempts: n,
+				Err:      timeoutError(ctx, err, ErrNoServer),
+			}
+		}
+	}
+}
+
+// dialTimeout dials to the addr giving up when ctx is done or timeout
+// expires.
+func dialTimeout(ctx context.Context, timeout time.Duration, addr string) (*net.UnixConn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := dialUnixContext(ctx, addr)
+	if err != nil {
+		return nil, timeoutError(ctx, err, ErrNoServer)
+	}
+	return conn, nil
+}
@@ -0,0 +1,117 @@
+package graceful
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	for i, exp := range []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	} {
+		if act := p.delay(i + 1); act != exp {
+			t.Errorf("unexpected delay of #%d retry: %v; want %v", i+1, act, exp)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("delay is out of jitter range: %v", d)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, test := range []struct {
+		name      string
+		serve     bool
+		retryable func(error) bool
+		attempts  int
+	}{
+		{
+			name:  "success",
+			serve: true,
+		},
+		{
+			name:     "no server",
+			attempts: 5,
+		},
+		{
+			name:      "not retryable",
+			retryable: func(error) bool { return false },
+			attempts:  1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addr := filepath.Join(dir, "graceful.sock")
+			if test.serve {
+				// Server appears after a few attempts.
+				server := &Server{Handler: FileHandler(f, nil)}
+				served := make(chan error, 1)
+				time.AfterFunc(30*time.Millisecond, func() {
+					served <- server.ListenAndServe(addr)
+				})
+				defer func() {
+					server.Close()
+					<-served
+				}()
+			}
+			client := &Client{Retry: &RetryPolicy{
+				Attempts:  5,
+				Backoff:   10 * time.Millisecond,
+				Jitter:    0.1,
+				Retryable: test.retryable,
+			}}
+			var received int
+			err := client.Receive(addr, func(fd int, _ io.Reader) error {
+				received++
+				return syscall.Close(fd)
+			})
+			if test.attempts == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if received != 1 {
+					t.Errorf("unexpected number of received descriptors: %d; want 1", received)
+				}
+				return
+			}
+			derr, ok := err.(*DialError)
+			if !ok {
+				t.Fatalf("unexpected error: %v; want *DialError", err)
+			}
+			if act, exp := derr.Attempts, test.attempts; act != exp {
+				t.Errorf("unexpected number of attempts: %d; want %d", act, exp)
+			}
+			if !isErrno(derr.Err, syscall.ENOENT) {
+				t.Errorf("unexpected last attempt error: %v; want %v", derr.Err, syscall.ENOENT)
+			}
+		})
+	}
+}
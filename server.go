@@ -2,12 +2,13 @@ package graceful
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -17,6 +18,10 @@ const (
 	msgDefaultBufferSize = 4096
 )
 
+// shutdownPollInterval is how often Server.Shutdown checks whether all
+// in-flight connections are done.
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Errors used by the Server and server helpers.
 var (
 	// ErrNotUnixListener is returned by a Server when not a *net.UnixListener
@@ -26,14 +31,50 @@ var (
 	// ErrLongWrite is returned by the ResponseWriter or Send* functions when
 	// data that want be written is too large to be buffered.
 	//
-	// In this case user should send data separately to the client.
+	// In this case user should send data separately to the client, for
+	// example, as a state stream (see StateWriter).
 	//
 	// Note that it is not possible to send messages larger than selected
-	// buffer size because client still will not receive it due to that client
-	// and server must use the same buffer size for reading and writing.
+	// buffer size because each message must be sent within a single write.
 	ErrLongWrite = errors.New("long write")
+
+	// ErrServerClosed is returned by the Server's Serve() and
+	// ListenAndServe() methods after a call to Shutdown() or Close().
+	ErrServerClosed = errors.New("graceful: server closed")
+
+	// ErrAckUnsupported is returned by WaitAck() when the client does not
+	// support acknowledgements.
+	ErrAckUnsupported = errors.New("client does not support acknowledgements")
+
+	// ErrNoAck is returned by WaitAck() when the client closes the
+	// connection without acknowledgement.
+	ErrNoAck = errors.New("client disconnected without acknowledgement")
+
+	// ErrWriteAfterAck is returned by the ResponseWriter when descriptor is
+	// written after WaitAck() call.
+	ErrWriteAfterAck = errors.New("write after acknowledgement")
+
+	// ErrReadyUnsupported is returned by WaitReady() when the client does
+	// not report its readiness.
+	ErrReadyUnsupported = errors.New("client does not report readiness")
+
+	// ErrNotReady is returned by WaitReady() when the client closes the
+	// connection without reporting readiness.
+	ErrNotReady = errors.New("client disconnected without reporting readiness")
 )
 
+// NackError is returned by WaitAck() when the client reports failure of
+// handling received descriptors and by WaitReady() when the client reports
+// that it is not ready.
+type NackError struct {
+	// Reason is an error message sent by the client.
+	Reason string
+}
+
+func (e *NackError) Error() string {
+	return "client rejected descriptors: " + e.Reason
+}
+
 // ResponseWriter describes an object that can receive a descriptor.
 type ResponseWriter interface {
 	Logger
@@ -42,6 +83,71 @@ type ResponseWriter interface {
 	Write(fd int, meta io.WriterTo) error
 }
 
+// Acknowledger is an interface implemented by ResponseWriters that allow
+// handlers to wait for the client acknowledgement.
+//
+// Note that the ResponseWriter passed to the Handler by a Server always
+// implements it, but the client may not support acknowledgements.
+type Acknowledger interface {
+	// WaitAck flushes buffered descriptors, tells the client that no more
+	// descriptors will be sent and waits until client acknowledges or
+	// rejects them.
+	//
+	// It returns nil if client successfully handled all received
+	// descriptors, *NackError if client reported failure and ErrNoAck if
+	// client closed the connection without acknowledgement. If client does
+	// not support acknowledgements, ErrAckUnsupported is returned.
+	//
+	// If ctx is done before client acknowledges descriptors, ctx.Err() is
+	// returned.
+	WaitAck(ctx context.Context) error
+}
+
+// Readier is an interface implemented by ResponseWriters that allow handlers
+// to wait for the client to report its readiness to serve.
+//
+// Note that the ResponseWriter passed to the Handler by a Server always
+// implements it, but the client may not report readiness. Clients report
+// readiness only if they are configured to do so (see Client.NotifyReady).
+type Readier interface {
+	// WaitReady waits for the client acknowledgement (see Acknowledger) and
+	// then waits until client reports its readiness by calling Ready() or
+	// failure by calling NotReady().
+	//
+	// It returns nil if client is ready, *NackError if client reported
+	// failure and ErrNotReady if client closed the connection without
+	// reporting readiness. If client does not report readiness,
+	// ErrReadyUnsupported is returned.
+	//
+	// If ctx is done or Server's ReadyTimeout expires before client reports
+	// readiness, error is returned.
+	WaitReady(ctx context.Context) error
+}
+
+// Requester is an interface implemented by ResponseWriters that allow
+// handlers to get names of descriptors requested by the client.
+//
+// Note that the ResponseWriter passed to the Handler by a Server always
+// implements it.
+type Requester interface {
+	// Requested returns names of descriptors requested by the client. It
+	// returns nil if client did not request particular descriptors.
+	Requested() []string
+}
+
+// Owner is an interface implemented by ResponseWriters that can take
+// ownership of objects backing written descriptors, such as *os.File
+// duplicates made by SendListener().
+//
+// Note that the ResponseWriter passed to the Handler by a Server always
+// implements it.
+type Owner interface {
+	// Own makes ResponseWriter responsible for closing c. It is closed right
+	// after the frame carrying descriptors written before is flushed or
+	// discarded.
+	Own(c io.Closer)
+}
+
 // ListenAndServe creates Server instance with given handler and then calls
 // server.ListenAndServe(addr) to handle incoming connections.
 func ListenAndServe(addr string, handler Handler) error {
@@ -63,7 +169,7 @@ var DefaultServer Server
 // Send dials to the "unix" network address addr and sends file descriptor to
 // the peer.
 func Send(addr string, fd int, meta io.WriterTo) error {
-	conn, err := net.Dial("unix", addr)
+	conn, err := dialUnix(addr)
 	if err != nil {
 		return err
 	}
@@ -93,49 +199,143 @@ func SendFileTo(conn net.Conn, file *os.File, meta io.WriterTo) error {
 // Server sends descriptors by calling Handler's Hanlde() method for every
 // accepted connection.
 //
-// Note that client and server using this package MUST select the same buffer
-// sizes for the meta fields and descriptors. Another option is to use the
-// global functions which use default sizes under the hood.
+// Server negotiates protocol version with every accepted connection. If
+// client speaks the protocol, each frame of descriptors is preceded by a
+// header announcing its size. That is, client and server are free to select
+// different buffer sizes. Otherwise, descriptors are sent in legacy format and
+// client and server MUST select the same buffer sizes.
+//
+// Note that Send* methods do not negotiate the protocol and always use the
+// legacy format.
 type Server struct {
 	// MsgBufferSize defines size of the buffer for meta fields.
 	// If MsgBufferSize is zero, then the default size is used.
+	// Clients reject frames with more than 16MB of meta, thus greater size
+	// is reduced to that limit.
 	MsgBufferSize int
 
 	// OOBBufferSize defines size of the buffer for serialized descriptors.
 	// If OOBBufferSize is zero, then the default size is used.
+	// Clients reject frames with more than 253 descriptors, thus greater
+	// size is reduced to that limit.
 	OOBBufferSize int
 
+	// HandshakeTimeout is the maximum duration to wait for the protocol
+	// preamble from the client. Clients that did not send preamble in time
+	// are served in legacy format.
+	// If HandshakeTimeout is zero, then the default timeout is used.
+	// If HandshakeTimeout is negative, then preamble is not awaited at all.
+	//
+	// Note that with negative HandshakeTimeout the probe made by another
+	// server (see RemoveStale) is recognized only if it is received before
+	// the connection is handled. Otherwise Handler is called for the probe
+	// as for a regular client.
+	HandshakeTimeout time.Duration
+
+	// RemoveStale makes ListenAndServe remove the socket file left by a
+	// crashed server. Before removal the file is probed by connecting to
+	// it. If some server accepts the connection, ListenAndServe fails with
+	// ErrSocketInUse.
+	//
+	// Note that servers of older versions of this package, as well as
+	// servers with negative HandshakeTimeout, may handle the probe as a
+	// regular client. That is, their Handler is called and could hand off
+	// the descriptors.
+	RemoveStale bool
+
+	// SocketMode and SocketOwner, if set, are applied to the socket file
+	// created by ListenAndServe.
+	//
+	// On Linux the socket file is created with permissions not wider than
+	// SocketMode. On other platforms SocketMode is applied after the socket
+	// is bound, thus there is a short window when the socket is accessible
+	// with permissions derived from umask. SocketOwner is always applied
+	// after the socket is bound. Thus these options must not be the only
+	// access control: use Authorizer to restrict peers.
+	SocketMode  os.FileMode
+	SocketOwner *SocketOwner
+
+	// Checksum makes server append the trailer to each frame, which holds
+	// CRC32 of the frame entries and the number of descriptors in it.
+	// Clients that support it verify the trailer and reject corrupt frames
+	// with *CorruptFrameError. Other clients receive frames without it.
+	Checksum bool
+
+	// ReadyTimeout is the maximum duration to wait for the client to report
+	// its readiness within WaitReady() call.
+	// If ReadyTimeout is zero, then only the context passed to WaitReady()
+	// limits it.
+	ReadyTimeout time.Duration
+
 	// Handler is a neccessary field that contains logic of sending descriptors
 	// to the every arrived connection.
 	Handler Handler
 
+	// Authorizer contains optional logic of checking credentials of the
+	// connected peer. If Authorizer returns non-nil error, the connection is
+	// closed before the Handler is called.
+	// If Authorizer is nil, then every peer is allowed, except the case of
+	// abstract socket addresses, which have no filesystem permissions. For
+	// such addresses only peers of the same user are allowed by default.
+	//
+	// Note that peer credentials are available only on linux. On other
+	// platforms every connection is rejected when Authorizer is not nil.
+	Authorizer Authorizer
+
 	// Logger contains optional implementation of any *Logger interfaces
 	// provided by this package.
 	// If Logger is nil, then no logging is made.
 	Logger interface{}
+
+	mu         sync.Mutex
+	inShutdown bool
+	listeners  map[*net.UnixListener]struct{}
+	sockets    map[*net.UnixListener]socketFile
+	conns      map[*net.UnixConn]struct{}
 }
 
 // ListenAndServe listens on the "unix" network address addr and then calls
 // Serve to handle incoming connections.
+//
+// The socket file is created with SocketMode and SocketOwner if they are set.
+// If RemoveStale is true and the socket file already exists, it is removed
+// unless some server is listening on it. The socket file is removed after
+// Serve returns, as well as by Shutdown() and Close().
 func (s *Server) ListenAndServe(addr string) error {
-	ln, err := net.Listen("unix", addr)
+	ln, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closeListenerLocked(ln)
+	}()
 	return s.Serve(ln)
 }
 
 // Serve accepts incoming connections on the listener l creating a new
 // goroutine for each. That goroutine calls s.Handler.Handle(conn, rw) and
 // exits.
+//
+// Serve always returns a non-nil error. After Shutdown() or Close(), the
+// returned error is ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
 	ln, ok := l.(*net.UnixListener)
 	if !ok {
 		return ErrNotUnixListener
 	}
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	abstract := isAbstract(ln.Addr().String())
+
 	for {
 		conn, err := ln.AcceptUnix()
+		if err != nil && s.shuttingDown() {
+			return ErrServerClosed
+		}
 		if terr, ok := err.(net.Error); ok && terr.Temporary() {
 			s.debugf("accept error: %v; delaying", terr)
 			time.Sleep(time.Millisecond * 5)
@@ -144,11 +344,16 @@ func (s *Server) Serve(l net.Listener) error {
 		if err != nil {
 			return err
 		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
 
 		name := nameConn(conn)
 		s.debugf("accepted connection: %q", name)
 
 		go func() {
+			defer s.trackConn(conn, false)
 			defer func() {
 				if err := recover(); err != nil {
 					const size = 64 << 10
@@ -160,9 +365,29 @@ func (s *Server) Serve(l net.Listener) error {
 				conn.Close()
 			}()
 
+			if err := s.authorize(conn, abstract); err != nil {
+				s.errorf("rejected connection %q: %v", name, err)
+				return
+			}
+
+			h, names, err := s.handshake(conn)
+			if err == errProbe {
+				s.debugf("probed by %q", name)
+				return
+			}
+			if err != nil {
+				s.errorf("handshake with %q error: %v", name, err)
+				return
+			}
+			s.debugf("negotiated protocol with %q: version %d", name, h.version)
+
 			// We do not handle err here cause it only be when conn is not a
 			// *net.UnixConn. Here it is always false.
 			resp, _ := s.newResponseWriter(conn)
+			resp.hello = h
+			resp.requested = names
+			// Close owned objects even if the handler panics.
+			defer resp.closeOwned()
 			s.Handler.Handle(conn, resp)
 
 			if err := resp.Flush(); err != nil {
@@ -174,6 +399,172 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// Shutdown gracefully shuts down the server. It closes all listeners passed
+// to Serve() and then waits for all in-flight connections to be handled and
+// flushed. That is, when Shutdown returns nil, every descriptor prepared by
+// the Handler has been written to its client.
+//
+// If the provided context expires before the shutdown is complete, Shutdown
+// returns the context's error. In-flight connections are not interrupted in
+// that case; use Close() to cancel them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.numConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners passed to Serve() and all in-flight
+// connections. Handlers and flushes that are in progress fail with an i/o
+// error.
+//
+// Close returns any error returned from closing the listeners.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// handshake reads protocol preamble from conn and replies with negotiated
+// one. It returns zero hello if client did not send preamble in time. If
+// client requested particular descriptors, their names are returned as well.
+func (s *Server) handshake(conn *net.UnixConn) (h hello, names []string, err error) {
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = handshakeDefaultTimeout
+	}
+	if timeout < 0 {
+		// Preamble is not awaited, but the probe could be received already.
+		if peekProbe(conn) {
+			return h, nil, errProbe
+		}
+		return h, nil, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return h, nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	p := make([]byte, helloSize)
+	n, err := io.ReadFull(conn, p)
+	if n == 0 && (isTimeout(err) || isEOF(err)) {
+		// Client does not speak the protocol.
+		return h, nil, nil
+	}
+	if err != nil {
+		return h, nil, err
+	}
+	if h, err = decodeHello(p); err != nil {
+		return h, nil, err
+	}
+	if h.has(capProbe) {
+		return h, nil, errProbe
+	}
+	if h.has(capRequest) {
+		if names, err = readRequest(conn); err != nil {
+			return h, nil, err
+		}
+	}
+	h = h.negotiate()
+	return h, names, writeHello(conn, h)
+}
+
+func (s *Server) authorize(conn *net.UnixConn, abstract bool) error {
+	return authorize(conn, s.Authorizer, abstract)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeListenersLocked() (err error) {
+	for ln := range s.listeners {
+		if cerr := s.closeListenerLocked(ln); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, ln)
+	}
+	return err
+}
+
+// closeListenerLocked closes ln and removes its socket file if it was created
+// by ListenAndServe.
+func (s *Server) closeListenerLocked(ln *net.UnixListener) error {
+	err := ln.Close()
+	if f, ok := s.sockets[ln]; ok {
+		if uerr := f.unlink(); uerr != nil {
+			s.errorf("remove socket file error: %v", uerr)
+		}
+		delete(s.sockets, ln)
+	}
+	return err
+}
+
+// trackListener adds or removes ln from the set of listeners being served.
+// It returns false if ln could not be added because server is shutting down.
+func (s *Server) trackListener(ln *net.UnixListener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[*net.UnixListener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes conn from the set of in-flight connections.
+// It returns false if conn could not be added because server is shutting
+// down.
+func (s *Server) trackConn(conn *net.UnixConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*net.UnixConn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
 // SendTo sends file descriptor fd and its meta to the given conn.
 func (s *Server) SendTo(conn net.Conn, fd int, meta io.WriterTo) error {
 	rw, err := s.newResponseWriter(conn)
@@ -190,16 +581,22 @@ func (s *Server) SendListenerTo(conn net.Conn, ln net.Listener, meta io.WriterTo
 	if err != nil {
 		return err
 	}
-	return SendListener(rw, ln, meta)
+	if err := SendListener(rw, ln, meta); err != nil {
+		return err
+	}
+	return rw.Flush()
 }
 
 // SendConnTo sends connection conn and its meta to the given connection dst.
 func (s *Server) SendConnTo(dst, conn net.Conn, meta io.WriterTo) error {
-	rw, err := s.newResponseWriter(conn)
+	rw, err := s.newResponseWriter(dst)
 	if err != nil {
 		return err
 	}
-	return SendConn(rw, conn, meta)
+	if err := SendConn(rw, conn, meta); err != nil {
+		return err
+	}
+	return rw.Flush()
 }
 
 // SendFileTo sends file and its meta to the given conn.
@@ -208,7 +605,10 @@ func (s *Server) SendFileTo(conn net.Conn, file *os.File, meta io.WriterTo) erro
 	if err != nil {
 		return err
 	}
-	return SendFile(rw, file, meta)
+	if err := SendFile(rw, file, meta); err != nil {
+		return err
+	}
+	return rw.Flush()
 }
 
 func (s *Server) newResponseWriter(conn net.Conn) (*response, error) {
@@ -220,10 +620,20 @@ func (s *Server) newResponseWriter(conn net.Conn) (*response, error) {
 		msgn = nonZero(s.MsgBufferSize, msgDefaultBufferSize)
 		oobn = nonZero(s.OOBBufferSize, oobDefaultBufferSize)
 	)
-	return newResponse(
+	// Frame must fit into limits of the protocol along with its trailer.
+	if max := maxFrameSize - frameTrailerSize; msgn > max {
+		msgn = max
+	}
+	if max := syscall.CmsgSpace(4) * maxFrameFds; oobn > max {
+		oobn = max
+	}
+	r := newResponse(
 		c, msgn, oobn,
 		serverLogger{s},
-	), nil
+	)
+	r.readyTimeout = s.ReadyTimeout
+	r.checksum = s.Checksum
+	return r, nil
 }
 
 func (s *Server) debugf(f string, args ...interface{}) {
@@ -247,13 +657,25 @@ func (s *Server) errorf(f string, args ...interface{}) {
 // response is an unexported ResponseWriter implementation.
 type response struct {
 	Logger
-	conn *net.UnixConn
+	conn      *net.UnixConn
+	hello     hello
+	requested []string
 
 	fds []int
 	buf []byte
 	n   int
 
-	err error
+	owned    []io.Closer
+	state    *stateWriter
+	checksum bool
+
+	err    error
+	acked  bool
+	ackErr error
+
+	readyTimeout time.Duration
+	readyDone    bool
+	readyErr     error
 }
 
 // newResponse returns ResponseWriter instance that writes descriptors to the
@@ -271,72 +693,109 @@ func newResponse(conn *net.UnixConn, msgn, oobn int, log Logger) *response {
 
 const msgHeaderSize = 4
 
-var zeroHeader = []byte{0, 0, 0, 0}
+func (r *response) Write(fd int, meta io.WriterTo) error {
+	return r.writeEntry(entry{fd: fd}, meta)
+}
+
+func (r *response) Own(c io.Closer) {
+	r.owned = append(r.owned, c)
+}
 
-func (r *response) Write(fd int, meta io.WriterTo) (ret error) {
+// closeOwned closes all owned objects.
+func (r *response) closeOwned() {
+	for i, c := range r.owned {
+		if err := c.Close(); err != nil {
+			r.Errorf("close owned object error: %v", err)
+		}
+		r.owned[i] = nil
+	}
+	r.owned = r.owned[:0]
+}
+
+func (r *response) Requested() []string {
+	return r.requested
+}
+
+// named reports whether frames are sent with named entries.
+func (r *response) named() bool {
+	return r.hello.has(capFrameHeader | capNames)
+}
+
+func (r *response) writeEntry(e entry, meta io.WriterTo) (ret error) {
 	if r.err != nil {
 		return r.err
 	}
+	if r.acked {
+		return ErrWriteAfterAck
+	}
+	if r.state != nil {
+		return ErrStateOpen
+	}
+	named := r.named()
+	if !named && !e.hasFd() {
+		// Client does not understand missing entries.
+		return nil
+	}
+	hsize := e.headerSize(named)
+	if hsize > len(r.buf) || len(e.name) > 0xffff {
+		return ErrLongWrite
+	}
 	var (
 		metaBytes []byte
 		mustCopy  bool
 	)
 	for {
-		if len(r.fds) == cap(r.fds) {
+		if e.hasFd() && len(r.fds) == cap(r.fds) {
 			// No space for a new descriptor.
 			goto flush
 		}
-		if len(r.buf)-r.n < msgHeaderSize {
+		if len(r.buf)-r.n < hsize {
 			// No space even for an empty meta.
 			goto flush
 		}
-		if meta == nil {
-			r.n += copy(r.buf[r.n:], zeroHeader)
-		} else {
-			if metaBytes == nil {
-				// Skip msgHeaderSize bytes and get the slice.
-				p := r.buf[r.n+msgHeaderSize:]
-				// Create bytes.Buffer with slice backed by rw.buf
-				// hoping that no reallocation will be made.
-				buf := bytes.NewBuffer(p[:0])
-				limbuf := &limitedWriter{
-					W: buf,
-					// Anyway, we can handle only len(rw.buf) bytes even after
-					// flushing.
-					N: len(r.buf) - msgHeaderSize,
-				}
-				n, err := meta.WriteTo(limbuf)
-				if limbuf.E {
-					return ErrLongWrite
-				}
-				if err != nil {
-					return err
-				}
-				if n == 0 {
-					meta = nil
-					continue
-				}
-
-				metaBytes = buf.Bytes()
-				if &metaBytes[0] != &p[0] {
-					// Reallocation was made. Must flush before. It is
-					// guaranteed that rw.buf fits metaBytes due to
-					// limitedWriter above.
-					mustCopy = true
-					goto flush
-				}
+		if meta != nil && metaBytes == nil {
+			// Skip hsize bytes and get the slice.
+			p := r.buf[r.n+hsize:]
+			// Create bytes.Buffer with slice backed by rw.buf hoping that no
+			// reallocation will be made.
+			buf := bytes.NewBuffer(p[:0])
+			limbuf := &limitedWriter{
+				W: buf,
+				// Anyway, we can handle only len(rw.buf) bytes even after
+				// flushing.
+				N: len(r.buf) - hsize,
 			}
-			// Buffer header bytes.
-			binary.LittleEndian.PutUint32(r.buf[r.n:], uint32(len(metaBytes)))
-			r.n += msgHeaderSize
-			// Buffer meta bytes.
-			if mustCopy {
-				r.n += copy(r.buf[r.n:], metaBytes)
-			} else {
-				r.n += len(metaBytes)
+			n, err := meta.WriteTo(limbuf)
+			if limbuf.E {
+				return ErrLongWrite
+			}
+			if err != nil {
+				return err
 			}
+			if n == 0 {
+				meta = nil
+				continue
+			}
+
+			metaBytes = buf.Bytes()
+			if len(p) == 0 || &metaBytes[0] != &p[0] {
+				// Reallocation was made. Must flush before. It is guaranteed
+				// that rw.buf fits metaBytes due to limitedWriter above.
+				mustCopy = true
+				goto flush
+			}
+		}
+		// Buffer header bytes.
+		r.n += e.putHeader(r.buf[r.n:], named, len(metaBytes))
+		// Buffer meta bytes.
+		if mustCopy {
+			r.n += copy(r.buf[r.n:], metaBytes)
+		} else {
+			r.n += len(metaBytes)
+		}
+		if e.hasFd() {
+			r.fds = append(r.fds, e.fd)
 		}
-		r.fds = append(r.fds, fd)
 		return nil
 
 	flush:
@@ -351,20 +810,74 @@ func (r *response) Write(fd int, meta io.WriterTo) (ret error) {
 	}
 }
 
+func (r *response) OpenState(name string) (io.WriteCloser, error) {
+	if !r.hello.has(capFrameHeader | capState) {
+		return nil, ErrStateUnsupported
+	}
+	if r.acked {
+		return nil, ErrWriteAfterAck
+	}
+	if r.state != nil {
+		return nil, ErrStateOpen
+	}
+	if len(name) > 0xffff {
+		return nil, ErrLongWrite
+	}
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	r.state = &stateWriter{r, name}
+	return r.state, nil
+}
+
+// writeState writes state chunk to the connection.
+func (r *response) writeState(name string, flags uint32, data []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.err = writeStateChunk(r.conn, name, flags, data)
+	return r.err
+}
+
+// Flush writes buffered descriptors to the connection. Owned objects are
+// closed after that, even if the write fails.
 func (r *response) Flush() error {
+	defer r.closeOwned()
 	if r.err != nil {
 		return r.err
 	}
-	if len(r.fds) == 0 {
+	if r.n == 0 {
 		return nil
 	}
 	var (
 		msgBytes = r.buf[:r.n]
-		oobBytes = syscall.UnixRights(r.fds...)
+		oobBytes []byte
 	)
-	msgn, oobn, err := r.conn.WriteMsgUnix(msgBytes, oobBytes, nil)
-	if err == nil && (msgn < len(msgBytes) || oobn < len(oobBytes)) {
-		err = io.ErrShortWrite
+	if len(r.fds) > 0 {
+		oobBytes = syscall.UnixRights(r.fds...)
+	}
+	var err error
+	if r.hello.has(capFrameHeader) {
+		h := frameHeader{
+			msgn: len(msgBytes),
+			fdn:  len(r.fds),
+		}
+		if r.named() {
+			h.flags |= frameNamed
+		}
+		if r.checksum && r.hello.has(capChecksum) {
+			h.flags |= frameChecksum
+			msgBytes = appendFrameTrailer(msgBytes, len(r.fds))
+			h.msgn = len(msgBytes)
+		}
+		err = writeFrameHeader(r.conn, h)
+	}
+	if err == nil {
+		var msgn, oobn int
+		msgn, oobn, err = r.conn.WriteMsgUnix(msgBytes, oobBytes, nil)
+		if err == nil && (msgn < len(msgBytes) || oobn < len(oobBytes)) {
+			err = io.ErrShortWrite
+		}
 	}
 	r.err = err
 	r.n = 0
@@ -372,6 +885,66 @@ func (r *response) Flush() error {
 	return err
 }
 
+func (r *response) WaitAck(ctx context.Context) error {
+	if !r.hello.has(capAck) {
+		return ErrAckUnsupported
+	}
+	if r.acked {
+		return ErrWriteAfterAck
+	}
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	r.acked = true
+	if err := r.conn.CloseWrite(); err != nil {
+		return err
+	}
+
+	stop := watchContext(ctx, r.conn)
+	err := readAck(r.conn)
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if err != nil && isEOF(err) {
+		err = ErrNoAck
+	}
+	r.ackErr = err
+	return err
+}
+
+func (r *response) WaitReady(ctx context.Context) error {
+	if !r.hello.has(capAck | capReady) {
+		return ErrReadyUnsupported
+	}
+	if r.readyDone {
+		return r.readyErr
+	}
+	if !r.acked {
+		if err := r.WaitAck(ctx); err != nil {
+			return err
+		}
+	} else if r.ackErr != nil {
+		return r.ackErr
+	}
+	if r.readyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.readyTimeout)
+		defer cancel()
+	}
+
+	stop := watchContext(ctx, r.conn)
+	err := readAck(r.conn)
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if err != nil && isEOF(err) {
+		err = ErrNotReady
+	}
+	r.readyDone = true
+	r.readyErr = err
+	return err
+}
+
 func sizeFromCmsgSpace(n int) int {
 	s := syscall.CmsgSpace(4)
 	return n / s
@@ -383,7 +956,7 @@ type limitedWriter struct {
 	E bool
 }
 
-func (w limitedWriter) Write(p []byte) (int, error) {
+func (w *limitedWriter) Write(p []byte) (int, error) {
 	if w.N <= 0 || len(p) > w.N {
 		w.E = true
 		return 0, ErrLongWrite
@@ -0,0 +1,61 @@
+package graceful
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerNoFdLeak(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	gln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		HandshakeTimeout: 10 * time.Millisecond,
+		Handler: SequenceHandler(
+			ListenerHandler(ln, nil),
+			PacketConnHandler(pc, nil),
+		),
+	}
+	go server.Serve(gln)
+
+	receive := func() {
+		err := Receive(gln.Addr().String(), func(fd int, _ io.Reader) error {
+			return syscall.Close(fd)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make runtime allocate its own descriptors (such as netpoller ones)
+	// before counting.
+	receive()
+
+	before := openFds(t)
+	for i := 0; i < 10; i++ {
+		receive()
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown closes gln.
+	after := openFds(t) + 1
+	if after != before {
+		t.Errorf("number of open descriptors changed from %d to %d", before, after)
+	}
+}
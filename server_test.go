@@ -2,6 +2,7 @@ package graceful
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -274,6 +276,386 @@ func TestResponseWriterBuffering(t *testing.T) {
 	}
 }
 
+func TestServerShutdown(t *testing.T) {
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var (
+		handling = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	server := &Server{
+		Handler: SequenceHandler(
+			CallbackHandler(func() {
+				close(handling)
+				<-release
+			}),
+			FileHandler(f, nil),
+		),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	received := make(chan int, 1)
+	go func() {
+		var n int
+		err := Receive(ln.Addr().String(), func(fd int, _ io.Reader) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Receive() error: %v", err)
+		}
+		received <- n
+	}()
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() with in-flight handler: %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve() returned %v; want %v", err, ErrServerClosed)
+	}
+
+	close(release)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() unexpected error: %v", err)
+	}
+	if act, exp := <-received, 1; act != exp {
+		t.Errorf("received %d descriptors; want %d", act, exp)
+	}
+	if err := server.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Serve() after Shutdown() returned %v; want %v", err, ErrServerClosed)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handling := make(chan struct{})
+	server := &Server{
+		Handler: HandlerFunc(func(conn net.Conn, _ ResponseWriter) {
+			close(handling)
+			// Block until Close() interrupts the connection.
+			conn.Read(make([]byte, 1))
+		}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handling
+
+	if err := server.Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve() returned %v; want %v", err, ErrServerClosed)
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() after Close() unexpected error: %v", err)
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, test := range []struct {
+		name   string
+		hello  *hello
+		reply  *hello
+		framed bool
+	}{
+		{
+			name: "legacy",
+		},
+		{
+			name:   "preamble",
+			hello:  &hello{protoVersion, supportedCaps &^ optionalCaps},
+			reply:  &hello{protoVersion, supportedCaps &^ optionalCaps},
+			framed: true,
+		},
+		{
+			name:   "future",
+			hello:  &hello{protoVersion + 1, ^optionalCaps},
+			reply:  &hello{protoVersion, supportedCaps &^ optionalCaps},
+			framed: true,
+		},
+		{
+			name:  "no caps",
+			hello: &hello{protoVersion, 0},
+			reply: &hello{protoVersion, 0},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &Server{
+				HandshakeTimeout: 10 * time.Millisecond,
+				Handler:          FileHandler(f, strings.NewReader("meta")),
+			}
+			go server.Serve(ln)
+			defer server.Close()
+
+			c, err := net.Dial("unix", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			conn := c.(*net.UnixConn)
+
+			if test.hello != nil {
+				if err := writeHello(conn, *test.hello); err != nil {
+					t.Fatal(err)
+				}
+				p := make([]byte, helloSize)
+				if _, err := io.ReadFull(conn, p); err != nil {
+					t.Fatal(err)
+				}
+				reply, err := decodeHello(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reply != *test.reply {
+					t.Errorf("unexpected reply: %+v; want %+v", reply, *test.reply)
+				}
+			}
+			magic, err := readMagic(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act, exp := magic == frameMagic, test.framed; act != exp {
+				t.Errorf("frame header sent: %t; want %t", act, exp)
+			}
+
+			var n int
+			err = ReceiveAllFrom(conn, func(_ int, meta io.Reader) error {
+				b, _ := ioutil.ReadAll(meta)
+				if act, exp := string(b), "meta"; act != exp {
+					t.Errorf("unexpected meta: %q; want %q", act, exp)
+				}
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("received %d descriptors; want 1", n)
+			}
+		})
+	}
+}
+
+// TestServerLegacyClient checks that the client which does not send hello
+// receives frames it is able to parse, that is, without frame header.
+func TestServerLegacyClient(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		HandshakeTimeout: 10 * time.Millisecond,
+		Handler:          FileHandler(f, strings.NewReader("meta")),
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	c, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*net.UnixConn)
+
+	// Parse the frame as the client that does not know about frame headers
+	// does: meta length, meta bytes and descriptor in a single message.
+	var (
+		msg = make([]byte, msgDefaultBufferSize)
+		oob = make([]byte, syscall.CmsgSpace(4))
+	)
+	msgn, oobn, _, _, err := conn.ReadMsgUnix(msg, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgn < 4 {
+		t.Fatalf("message is too short: %d bytes", msgn)
+	}
+	size := int(binary.LittleEndian.Uint32(msg))
+	if size != len("meta") || msgn != 4+size || string(msg[4:msgn]) != "meta" {
+		t.Fatalf("unexpected legacy frame: %q", msg[:msgn])
+	}
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmsgs) != 1 {
+		t.Fatalf("received %d control messages; want 1", len(cmsgs))
+	}
+	fds, err := syscall.ParseUnixRights(&cmsgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+	if len(fds) != 1 {
+		t.Errorf("received %d descriptors; want 1", len(fds))
+	}
+}
+
+func TestServerFrameLimits(t *testing.T) {
+	client, server, err := unixSocketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	s := Server{
+		MsgBufferSize: 2 * maxFrameSize,
+		OOBBufferSize: syscall.CmsgSpace(4) * 2 * maxFrameFds,
+	}
+	rw, err := s.newResponseWriter(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rw.buf) + frameTrailerSize; n > maxFrameSize {
+		t.Errorf("frame could be %d bytes; want at most %d", n, maxFrameSize)
+	}
+	if n := cap(rw.fds); n > maxFrameFds {
+		t.Errorf("frame could hold %d descriptors; want at most %d", n, maxFrameFds)
+	}
+}
+
+func TestServerAck(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, test := range []struct {
+		name    string
+		receive func(addr string) error
+		err     error
+	}{
+		{
+			name: "ack",
+			receive: func(addr string) error {
+				return Receive(addr, func(int, io.Reader) error {
+					return nil
+				})
+			},
+		},
+		{
+			name: "nack",
+			receive: func(addr string) error {
+				return Receive(addr, func(int, io.Reader) error {
+					return fmt.Errorf("can not listen")
+				})
+			},
+			err: &NackError{Reason: "can not listen"},
+		},
+		{
+			name: "no ack",
+			receive: func(addr string) error {
+				conn, err := net.Dial("unix", addr)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				writeHello(conn.(*net.UnixConn), hello{protoVersion, supportedCaps &^ optionalCaps})
+				_, err = ioutil.ReadAll(conn)
+				return err
+			},
+			err: ErrNoAck,
+		},
+		{
+			name: "legacy",
+			receive: func(addr string) error {
+				conn, err := net.Dial("unix", addr)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				return ReceiveAllFrom(conn, func(int, io.Reader) error {
+					return nil
+				})
+			},
+			err: ErrAckUnsupported,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			acked := make(chan error, 1)
+			server := &Server{
+				HandshakeTimeout: 10 * time.Millisecond,
+				Handler: SequenceHandler(
+					FileHandler(f, nil),
+					AckHandler(func(err error) {
+						acked <- err
+					}),
+				),
+			}
+			go server.Serve(ln)
+			defer server.Close()
+
+			if err := test.receive(ln.Addr().String()); err != nil && test.err == nil {
+				t.Fatal(err)
+			}
+			err = <-acked
+			if nerr, ok := test.err.(*NackError); ok {
+				if act, ok := err.(*NackError); !ok || *act != *nerr {
+					t.Errorf("unexpected ack error: %v; want %v", err, nerr)
+				}
+			} else if err != test.err {
+				t.Errorf("unexpected ack error: %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
 //func TestListenerServer(t *testing.T) {
 //	var err error
 //	lns := make([]net.Listener, 4)
@@ -379,3 +761,181 @@ func StandardLogger(prefix string, level byte) Logger {
 		},
 	)
 }
+
+func TestServerReady(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, test := range []struct {
+		name    string
+		notify  bool
+		ready   func() error
+		timeout time.Duration
+		err     error
+	}{
+		{
+			name:   "ready",
+			notify: true,
+			ready:  Ready,
+		},
+		{
+			name:   "not ready",
+			notify: true,
+			ready: func() error {
+				return NotReady(fmt.Errorf("can not serve"))
+			},
+			err: &NackError{Reason: "can not serve"},
+		},
+		{
+			name:   "disconnect",
+			notify: true,
+			ready: func() error {
+				ready.mu.Lock()
+				defer ready.mu.Unlock()
+				for _, rc := range ready.conns {
+					rc.conn.Close()
+				}
+				ready.conns = nil
+				return nil
+			},
+			err: ErrNotReady,
+		},
+		{
+			name:    "timeout",
+			notify:  true,
+			timeout: 10 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+		{
+			name: "unsupported",
+			err:  ErrReadyUnsupported,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			readyc := make(chan error, 1)
+			server := &Server{
+				HandshakeTimeout: 10 * time.Millisecond,
+				ReadyTimeout:     test.timeout,
+				Handler: SequenceHandler(
+					FileHandler(f, nil),
+					ReadyHandler(func(err error) {
+						readyc <- err
+					}),
+				),
+			}
+			go server.Serve(ln)
+			defer server.Close()
+
+			c := Client{NotifyReady: test.notify}
+			err = c.Receive(ln.Addr().String(), func(fd int, _ io.Reader) error {
+				return syscall.Close(fd)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.ready != nil {
+				if err := test.ready(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = <-readyc
+			if nerr, ok := test.err.(*NackError); ok {
+				if act, ok := err.(*NackError); !ok || *act != *nerr {
+					t.Errorf("unexpected ready error: %v; want %v", err, nerr)
+				}
+			} else if err != test.err {
+				t.Errorf("unexpected ready error: %v; want %v", err, test.err)
+			}
+			// Release connections kept by timed out cases.
+			Ready()
+		})
+	}
+}
+
+func TestServerChecksum(t *testing.T) {
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	server := &Server{
+		Checksum: true,
+		Handler: SequenceHandler(
+			FileHandler(f, Meta{"foo": "bar"}),
+			FileHandler(f, nil),
+		),
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := dialUnix(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeHello(conn, hello{protoVersion, supportedCaps &^ optionalCaps}); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, helloSize)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		t.Fatal(err)
+	}
+	h, err := decodeHello(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		flags uint32
+		n     int
+	)
+	for {
+		magic, err := readMagic(conn)
+		if err != nil && isEOF(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if magic == frameMagic {
+			p := make([]byte, frameHeaderSize)
+			if _, err := peek(conn, p); err != nil {
+				t.Fatal(err)
+			}
+			fh, err := decodeFrameHeader(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flags = fh.flags
+		}
+		err = (&Client{}).receive(conn, &h, func(e entry, _ io.Reader) error {
+			n++
+			return syscall.Close(e.fd)
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flags&frameChecksum == 0 {
+		t.Errorf("frame was sent without checksum")
+	}
+	if n != 2 {
+		t.Errorf("received %d descriptors; want 2", n)
+	}
+}
@@ -0,0 +1,180 @@
+package graceful
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Errors used by snapshots.
+var (
+	// ErrSnapshotUnsupported is returned when snapshots are not supported on
+	// the platform.
+	ErrSnapshotUnsupported = errors.New("graceful: snapshots are not supported")
+
+	// ErrSnapshotNotSealed is returned by OpenSnapshot() when the received
+	// file could be modified by the sender.
+	ErrSnapshotNotSealed = errors.New("graceful: snapshot file is not sealed")
+
+	// ErrNotSnapshot is returned by the Descriptors when descriptor is not
+	// a snapshot.
+	ErrNotSnapshot = errors.New("graceful: descriptor is not a snapshot")
+)
+
+// MetaSnapshot is a Meta key that marks the descriptor as a snapshot. Its
+// value is the snapshot size.
+const MetaSnapshot = "snapshot"
+
+// Snapshot is a read-only application state received as an in-memory file.
+//
+// Snapshot is sent by SendSnapshot() as a sealed memfd file, so the data is
+// passed to the new process without copying it through the socket. On the
+// receiving side the file is mapped into memory.
+type Snapshot struct {
+	file *os.File
+	data []byte
+}
+
+// SendSnapshot writes application snapshot by fn into a sealed in-memory
+// file and sends it with given name as an ordinary descriptor. Meta of the
+// descriptor marks it as snapshot (see MetaSnapshot).
+//
+// It returns ErrSnapshotUnsupported on platforms other than Linux.
+func SendSnapshot(resp ResponseWriter, name string, fn func(w io.Writer) error) error {
+	f, err := createSnapshot(name, fn)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	meta := Meta{
+		MetaName:     name,
+		MetaKind:     KindFile.String(),
+		MetaSnapshot: info.Size(),
+	}
+	return sendDup(resp, KindFile, f, meta)
+}
+
+// SnapshotHandler returns a Handler that sends application snapshot written
+// by fn with given name. See SendSnapshot() for details.
+func SnapshotHandler(name string, fn func(w io.Writer) error) Handler {
+	return HandlerFunc(func(_ net.Conn, resp ResponseWriter) {
+		if err := SendSnapshot(resp, name, fn); err != nil {
+			resp.Errorf("send snapshot %q error: %v", name, err)
+		}
+	})
+}
+
+// IsSnapshot reports whether m describes a snapshot.
+func IsSnapshot(m Meta) bool {
+	_, ok := m[MetaSnapshot]
+	return ok
+}
+
+// createSnapshot writes snapshot by fn into a new in-memory file and seals
+// it. Returned file offset is at its beginning.
+func createSnapshot(name string, fn func(w io.Writer) error) (*os.File, error) {
+	f, err := memfdCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = fn(f); err == nil {
+		err = sealFile(f)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenSnapshot maps the received snapshot descriptor fd into memory
+// read-only. Snapshot takes ownership of fd, which is closed by the
+// Snapshot's Close() method.
+//
+// It returns ErrSnapshotNotSealed if the file is not sealed against
+// modification. In this case fd is not closed.
+func OpenSnapshot(fd int) (*Snapshot, error) {
+	if err := checkSeals(fd); err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, os.NewSyscallError("fstat", err)
+	}
+	s := &Snapshot{}
+	if st.Size > 0 {
+		data, err := syscall.Mmap(fd, 0, int(st.Size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, os.NewSyscallError("mmap", err)
+		}
+		s.data = data
+	}
+	s.file = os.NewFile(uintptr(fd), "snapshot")
+	return s, nil
+}
+
+// Bytes returns the snapshot data. It is valid until s is closed and must not
+// be modified.
+func (s *Snapshot) Bytes() []byte {
+	return s.data
+}
+
+// Size returns the size of the snapshot.
+func (s *Snapshot) Size() int64 {
+	return int64(len(s.data))
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *Snapshot) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("graceful: negative snapshot offset")
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps the snapshot and closes its file.
+func (s *Snapshot) Close() error {
+	var err error
+	if s.data != nil {
+		err = syscall.Munmap(s.data)
+		s.data = nil
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Snapshot takes descriptor with given name and opens it as a Snapshot. It
+// returns ErrNotSnapshot if descriptor's meta does not mark it as snapshot.
+func (ds *Descriptors) Snapshot(name string) (s *Snapshot, err error) {
+	check := func(d Descriptor) error {
+		if !IsSnapshot(d.Meta) {
+			return ErrNotSnapshot
+		}
+		return nil
+	}
+	err = ds.take(name, []Kind{KindFile}, check, func(d Descriptor) (err error) {
+		if s, err = OpenSnapshot(d.Fd); err != nil {
+			syscall.Close(d.Fd)
+		}
+		return err
+	})
+	return s, err
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package graceful
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// memfd_create(2) is not provided by the syscall package.
+var sysMemfdCreate = map[string]uintptr{
+	"386":     356,
+	"amd64":   319,
+	"arm":     385,
+	"arm64":   279,
+	"riscv64": 279,
+	"ppc64":   360,
+	"ppc64le": 360,
+	"s390x":   350,
+}[runtime.GOARCH]
+
+const (
+	mfdCloexec       = 0x1
+	mfdAllowSealing  = 0x2
+	fcntlAddSeals    = 1033
+	fcntlGetSeals    = 1034
+	sealSeal         = 0x1
+	sealShrink       = 0x2
+	sealGrow         = 0x4
+	sealWrite        = 0x8
+	snapshotSeals    = sealSeal | sealShrink | sealGrow | sealWrite
+	snapshotRequired = sealShrink | sealWrite
+)
+
+func memfdCreate(name string) (*os.File, error) {
+	if sysMemfdCreate == 0 {
+		return nil, ErrSnapshotUnsupported
+	}
+	p, err := syscall.BytePtrFromString("graceful:" + name)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.Syscall(
+		sysMemfdCreate,
+		uintptr(unsafe.Pointer(p)),
+		mfdCloexec|mfdAllowSealing,
+		0,
+	)
+	if errno == syscall.ENOSYS {
+		return nil, ErrSnapshotUnsupported
+	}
+	if errno != 0 {
+		return nil, os.NewSyscallError("memfd_create", errno)
+	}
+	return os.NewFile(fd, name), nil
+}
+
+func sealFile(f *os.File) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_FCNTL, f.Fd(), fcntlAddSeals, snapshotSeals,
+	)
+	if errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+	return nil
+}
+
+func checkSeals(fd int) error {
+	seals, _, errno := syscall.Syscall(
+		syscall.SYS_FCNTL, uintptr(fd), fcntlGetSeals, 0,
+	)
+	if errno == syscall.EINVAL {
+		// File does not support sealing at all.
+		return ErrSnapshotNotSealed
+	}
+	if errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+	if seals&snapshotRequired != snapshotRequired {
+		return ErrSnapshotNotSealed
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package graceful
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	data := make([]byte, 5<<20)
+	rand.Read(data)
+
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Handler: SnapshotHandler("state", func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	ds, err := ReceiveDescriptors(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	d, ok := ds.Get("state")
+	if !ok {
+		t.Fatalf("snapshot descriptor is not received")
+	}
+	if _, err := syscall.Write(d.Fd, []byte("x")); err != syscall.EPERM {
+		t.Errorf("unexpected error on write to snapshot: %v; want %v", err, syscall.EPERM)
+	}
+
+	s, err := ds.Snapshot("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if act, exp := s.Size(), int64(len(data)); act != exp {
+		t.Errorf("unexpected snapshot size: %d; want %d", act, exp)
+	}
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("unexpected snapshot data")
+	}
+	p := make([]byte, 100)
+	if _, err := s.ReadAt(p, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[1<<20:1<<20+100]) {
+		t.Errorf("unexpected data read at offset")
+	}
+	if n, err := s.ReadAt(p, int64(len(data))-10); n != 10 || err != io.EOF {
+		t.Errorf("unexpected result of read at the end: %d, %v; want 10, EOF", n, err)
+	}
+}
+
+func TestOpenSnapshotNotSealed(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := OpenSnapshot(int(f.Fd())); err != ErrSnapshotNotSealed {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrSnapshotNotSealed)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package graceful
+
+import "os"
+
+func memfdCreate(name string) (*os.File, error) {
+	return nil, ErrSnapshotUnsupported
+}
+
+func sealFile(f *os.File) error {
+	return ErrSnapshotUnsupported
+}
+
+func checkSeals(fd int) error {
+	return ErrSnapshotUnsupported
+}
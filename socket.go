@@ -0,0 +1,154 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrSocketInUse is returned by the Server's ListenAndServe() when the socket
+// file exists and some server is listening on it, as well as when abstract
+// socket address is already bound.
+var ErrSocketInUse = errors.New("graceful: socket is in use by another server")
+
+// ErrAbstractUnsupported is returned when abstract socket address is used on
+// the platform that does not support it.
+var ErrAbstractUnsupported = errors.New("graceful: abstract sockets are not supported")
+
+// errProbe is returned by the Server's handshake when client only checks
+// whether server is alive.
+var errProbe = errors.New("probe")
+
+// SocketOwner describes owner of the socket file.
+type SocketOwner struct {
+	UID, GID int
+}
+
+// socketFile describes socket file created by the Server.
+type socketFile struct {
+	path string
+	info os.FileInfo
+}
+
+// unlink removes the socket file if it was not replaced by another one since
+// it was created. That is, it does not remove socket file created by the next
+// application instance.
+func (f socketFile) unlink() error {
+	info, err := os.Lstat(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, f.info) {
+		return nil
+	}
+	return os.Remove(f.path)
+}
+
+// isAbstract reports whether addr is an abstract socket address. Such
+// addresses start with '@' and are not bound to the filesystem.
+func isAbstract(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@'
+}
+
+func checkAddr(addr string) error {
+	if isAbstract(addr) && !abstractSupported {
+		return ErrAbstractUnsupported
+	}
+	return nil
+}
+
+// dialUnix dials to the "unix" network address addr.
+func dialUnix(addr string) (*net.UnixConn, error) {
+	return dialUnixContext(context.Background(), addr)
+}
+
+// dialUnixContext is like dialUnix(), but it gives up when ctx is done.
+func dialUnixContext(ctx context.Context, addr string) (*net.UnixConn, error) {
+	if err := checkAddr(addr); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UnixConn), nil
+}
+
+// listen creates "unix" listener on addr and applies socket options to its
+// file. Socket options are ignored for abstract addresses.
+func (s *Server) listen(addr string) (*net.UnixListener, error) {
+	if err := checkAddr(addr); err != nil {
+		return nil, err
+	}
+	if isAbstract(addr) {
+		// There is no file to set up or remove. Abstract address is released
+		// when its socket is closed, thus it is never stale.
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: addr, Net: "unix"})
+		if isErrno(err, syscall.EADDRINUSE) {
+			err = ErrSocketInUse
+		}
+		return ln, err
+	}
+	ln, err := listenUnix(addr, s.SocketMode)
+	if err != nil && s.RemoveStale && isErrno(err, syscall.EADDRINUSE) {
+		if err = removeStale(addr); err == nil {
+			ln, err = listenUnix(addr, s.SocketMode)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Socket file is removed by the Server only if it was not replaced.
+	ln.SetUnlinkOnClose(false)
+
+	f := socketFile{path: addr}
+	if f.info, err = os.Lstat(addr); err == nil && s.SocketMode != 0 {
+		err = os.Chmod(addr, s.SocketMode)
+	}
+	if err == nil && s.SocketOwner != nil {
+		err = os.Lchown(addr, s.SocketOwner.UID, s.SocketOwner.GID)
+	}
+	if err != nil {
+		ln.Close()
+		os.Remove(addr)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sockets == nil {
+		s.sockets = make(map[*net.UnixListener]socketFile)
+	}
+	s.sockets[ln] = f
+	return ln, nil
+}
+
+// removeStale removes socket file at addr if no server is listening on it.
+func removeStale(addr string) error {
+	info, err := os.Lstat(addr)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("graceful: %s is not a socket", addr)
+	}
+	conn, err := dialUnix(addr)
+	if err == nil {
+		// Error is not checked here cause we are only interested in
+		// whether server is alive.
+		writeHello(conn, hello{protoVersion, capProbe})
+		conn.Close()
+		return ErrSocketInUse
+	}
+	if !isErrno(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(addr)
+}
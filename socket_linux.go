@@ -0,0 +1,55 @@
+package graceful
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// abstractSupported reports whether abstract socket addresses are supported.
+const abstractSupported = true
+
+// listenUnix creates "unix" listener bound to the file at addr. If mode is
+// non-zero, then the file is created with permissions not wider than mode.
+// That is, nobody else could connect to it before the exact mode is applied.
+func listenUnix(addr string, mode os.FileMode) (*net.UnixListener, error) {
+	uaddr := &net.UnixAddr{Name: addr, Net: "unix"}
+	if mode == 0 {
+		return net.ListenUnix("unix", uaddr)
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), addr)
+	defer f.Close()
+
+	// Linux creates the socket file with permissions of the socket inode
+	// masked by umask.
+	if err := syscall.Fchmod(fd, uint32(mode.Perm())); err != nil {
+		return nil, os.NewSyscallError("fchmod", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: addr}); err != nil {
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "unix",
+			Addr: uaddr,
+			Err:  os.NewSyscallError("bind", err),
+		}
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		os.Remove(addr)
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "unix",
+			Addr: uaddr,
+			Err:  os.NewSyscallError("listen", err),
+		}
+	}
+	ln, err := net.FileListener(f)
+	if err != nil {
+		os.Remove(addr)
+		return nil, err
+	}
+	return ln.(*net.UnixListener), nil
+}
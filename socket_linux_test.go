@@ -0,0 +1,122 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	addr := fmt.Sprintf("@graceful-test-%d", os.Getpid())
+
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	server := &Server{
+		Handler: FileHandler(f, nil),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe(addr)
+	}()
+	waitListener(t, server)
+	defer func() {
+		server.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("unexpected error: %v; want %v", err, ErrServerClosed)
+		}
+	}()
+
+	another := &Server{RemoveStale: true}
+	if err := another.ListenAndServe(addr); err != ErrSocketInUse {
+		t.Errorf("unexpected error: %v; want %v", err, ErrSocketInUse)
+	}
+
+	var n int
+	err = Receive(addr, func(fd int, _ io.Reader) error {
+		n++
+		return syscall.Close(fd)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("received %d descriptors; want 1", n)
+	}
+
+	reject := errors.New("rejected")
+	c := Client{
+		Authorizer: AuthorizerFunc(func(cred PeerCred) error {
+			if cred.PID != int32(os.Getpid()) {
+				t.Errorf("unexpected server pid: %d", cred.PID)
+			}
+			return reject
+		}),
+	}
+	err = c.Receive(addr, func(fd int, _ io.Reader) error {
+		t.Errorf("descriptor received from rejected server")
+		return syscall.Close(fd)
+	})
+	if err != reject {
+		t.Errorf("unexpected error: %v; want %v", err, reject)
+	}
+}
+
+// waitListener waits for the server to start serving.
+func waitListener(t *testing.T, s *Server) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.listeners)
+		s.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not start serving")
+}
+
+func TestListenUnixMode(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "graceful.sock")
+
+	// With zero umask the socket file would be accessible by anyone if mode
+	// was applied after bind.
+	umask := syscall.Umask(0)
+	ln, err := listenUnix(addr, 0600)
+	syscall.Umask(umask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	info, err := os.Lstat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := info.Mode().Perm(), os.FileMode(0600); act != exp {
+		t.Errorf("unexpected socket file mode: %v; want %v", act, exp)
+	}
+	if act, exp := ln.Addr().String(), addr; act != exp {
+		t.Errorf("unexpected listener address: %q; want %q", act, exp)
+	}
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package graceful
+
+import (
+	"net"
+	"os"
+)
+
+const abstractSupported = false
+
+// listenUnix creates "unix" listener bound to the file at addr. Permissions of
+// the file are derived from umask, mode is ignored.
+func listenUnix(addr string, _ os.FileMode) (*net.UnixListener, error) {
+	return net.ListenUnix("unix", &net.UnixAddr{Name: addr, Net: "unix"})
+}
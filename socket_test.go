@@ -0,0 +1,214 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerListenAndServe(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name   string
+		stale  bool
+		live   bool
+		remove bool
+		err    error
+	}{
+		{
+			name: "no file",
+		},
+		{
+			name:   "stale",
+			stale:  true,
+			remove: true,
+		},
+		{
+			name:  "stale not removed",
+			stale: true,
+			err:   syscall.EADDRINUSE,
+		},
+		{
+			name:   "live",
+			live:   true,
+			remove: true,
+			err:    ErrSocketInUse,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addr := filepath.Join(dir, "graceful.sock")
+			defer os.Remove(addr)
+
+			handled := make(chan struct{}, 1)
+			if test.stale || test.live {
+				ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: addr, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.stale {
+					ln.SetUnlinkOnClose(false)
+					ln.Close()
+				} else {
+					live := &Server{Handler: CallbackHandler(func() {
+						handled <- struct{}{}
+					})}
+					go live.Serve(ln)
+					defer live.Close()
+				}
+			}
+
+			server := &Server{
+				RemoveStale: test.remove,
+				SocketMode:  0600,
+				SocketOwner: &SocketOwner{
+					UID: os.Getuid(),
+					GID: os.Getgid(),
+				},
+				Handler: CallbackHandler(func() {}),
+			}
+			served := make(chan error, 1)
+			go func() {
+				served <- server.ListenAndServe(addr)
+			}()
+
+			if test.err != nil {
+				err := <-served
+				if errno, ok := test.err.(syscall.Errno); ok {
+					if !isErrno(err, errno) {
+						t.Fatalf("unexpected error: %v; want %v", err, test.err)
+					}
+				} else if err != test.err {
+					t.Fatalf("unexpected error: %v; want %v", err, test.err)
+				}
+				select {
+				case <-handled:
+					t.Errorf("probe was handled by the live server")
+				case <-time.After(handshakeDefaultTimeout * 2):
+				}
+				return
+			}
+			waitSocket(t, server)
+			info, err := os.Lstat(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act, exp := info.Mode().Perm(), os.FileMode(0600); act != exp {
+				t.Errorf("unexpected socket file mode: %v; want %v", act, exp)
+			}
+			if err := server.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != ErrServerClosed {
+				t.Errorf("unexpected error: %v; want %v", err, ErrServerClosed)
+			}
+			if _, err := os.Lstat(addr); !os.IsNotExist(err) {
+				t.Errorf("socket file was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerCloseReplacedSocket(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "graceful.sock")
+
+	server := &Server{Handler: CallbackHandler(func() {})}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe(addr)
+	}()
+	waitSocket(t, server)
+
+	// Next instance replaces the socket file.
+	if err := os.Remove(addr); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	server.Close()
+	<-served
+	if _, err := os.Lstat(addr); err != nil {
+		t.Errorf("socket file of the next instance was removed: %v", err)
+	}
+}
+
+// waitSocket waits for the server to create its socket file.
+func waitSocket(t *testing.T, s *Server) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.sockets)
+		s.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("socket file was not created")
+}
+
+func TestServerRemoveStaleNoHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "graceful.sock")
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: addr, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		RemoveStale: true,
+		Handler:     CallbackHandler(func() {}),
+	}
+	// The probe connection is left in the accept queue of ln until the live
+	// server below starts serving.
+	if err := server.ListenAndServe(addr); err != ErrSocketInUse {
+		t.Fatalf("unexpected error: %v; want %v", err, ErrSocketInUse)
+	}
+
+	var (
+		handled = make(chan struct{}, 1)
+		probed  = make(chan struct{}, 1)
+	)
+	live := &Server{
+		HandshakeTimeout: -1,
+		Handler: CallbackHandler(func() {
+			handled <- struct{}{}
+		}),
+		Logger: LoggerFunc(func(f string, args ...interface{}) {
+			if strings.HasPrefix(f, "probed") {
+				probed <- struct{}{}
+			}
+		}, nil, nil),
+	}
+	go live.Serve(ln)
+	defer live.Close()
+
+	select {
+	case <-probed:
+	case <-handled:
+		t.Fatalf("probe was handled by the live server")
+	case <-time.After(time.Second):
+		t.Fatalf("probe was not received")
+	}
+}
@@ -0,0 +1,255 @@
+package graceful
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// Errors used by state streams.
+var (
+	// ErrStateUnsupported is returned by OpenState() when the client does
+	// not support state streams.
+	ErrStateUnsupported = errors.New("client does not support state streams")
+
+	// ErrStateOpen is returned by the ResponseWriter when descriptor or
+	// another state stream is written while some state stream is not
+	// closed yet.
+	ErrStateOpen = errors.New("state stream is open")
+
+	// ErrBadState is returned by a Client when the server sends malformed
+	// state stream.
+	ErrBadState = errors.New("malformed state stream")
+)
+
+// errStateClosed is returned by the state stream writer after it is closed.
+var errStateClosed = errors.New("write to closed state stream")
+
+// StateWriter is an interface implemented by ResponseWriters that allow
+// handlers to send application state of arbitrary size, such as session
+// caches, along with descriptors.
+//
+// Note that the ResponseWriter passed to the Handler by a Server always
+// implements it, but the client may not support state streams.
+type StateWriter interface {
+	// OpenState flushes buffered descriptors and opens the state stream with
+	// given name. Data written to the stream is sent to the client in
+	// chunks. Stream must be closed before any other descriptor or stream is
+	// written.
+	//
+	// If client does not support state streams, ErrStateUnsupported is
+	// returned.
+	OpenState(name string) (io.WriteCloser, error)
+}
+
+// StateCallback describes a function that will be called on each state
+// stream received by a Client. Its arguments are the name of the stream and
+// the reader of its data. Reader returns io.EOF after the last chunk of the
+// stream.
+//
+// Note that reader is only valid until callback returns. Unread data of the
+// stream is discarded after that.
+//
+// If the callback returns non-nil error, then the receiving exits
+// immediately with that error.
+type StateCallback func(name string, r io.Reader) error
+
+// OpenState opens the state stream with given name. It returns
+// ErrStateUnsupported if resp does not implement StateWriter. See
+// StateWriter for details.
+func OpenState(resp ResponseWriter, name string) (io.WriteCloser, error) {
+	s, ok := resp.(StateWriter)
+	if !ok {
+		return nil, ErrStateUnsupported
+	}
+	return s.OpenState(name)
+}
+
+// SendState sends all data from r as the state stream with given name.
+func SendState(resp ResponseWriter, name string, r io.Reader) error {
+	w, err := OpenState(resp, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// StateHandler returns a Handler that opens the state stream with given name
+// and calls fn to write the state to it.
+func StateHandler(name string, fn func(w io.Writer) error) Handler {
+	return HandlerFunc(func(_ net.Conn, resp ResponseWriter) {
+		w, err := OpenState(resp, name)
+		if err == nil {
+			if err = fn(w); err == nil {
+				err = w.Close()
+			}
+		}
+		if err != nil {
+			resp.Errorf("send state %q error: %v", name, err)
+		}
+	})
+}
+
+// State chunk flags.
+const (
+	// stateEnd means that chunk is the last one of the stream.
+	stateEnd = 1 << iota
+)
+
+const (
+	stateHeaderSize = 16
+
+	// stateChunkSize is the maximum size of data within a chunk sent by the
+	// server.
+	stateChunkSize = 64 << 10
+
+	// maxStateChunk limits the size of data within a received chunk.
+	maxStateChunk = 1 << 20
+)
+
+// stateMagic marks the beginning of a state chunk.
+var stateMagic = [4]byte{'G', 'R', 'F', 'S'}
+
+// stateChunk is a header of a state chunk. Chunk is encoded as stateMagic, 4
+// bytes of little-endian data length, 4 bytes of little-endian flags, 4 bytes
+// of little-endian name length, name bytes and data bytes.
+type stateChunk struct {
+	name  string
+	size  int
+	flags uint32
+}
+
+func writeStateChunk(conn *net.UnixConn, name string, flags uint32, data []byte) error {
+	p := make([]byte, stateHeaderSize+len(name)+len(data))
+	copy(p, stateMagic[:])
+	binary.LittleEndian.PutUint32(p[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(p[8:], flags)
+	binary.LittleEndian.PutUint32(p[12:], uint32(len(name)))
+	n := stateHeaderSize + copy(p[stateHeaderSize:], name)
+	copy(p[n:], data)
+	return writeFull(conn, p)
+}
+
+func readStateChunk(r io.Reader) (c stateChunk, err error) {
+	p := make([]byte, stateHeaderSize)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return c, err
+	}
+	if string(p[:4]) != string(stateMagic[:]) {
+		return c, ErrBadState
+	}
+	size := binary.LittleEndian.Uint32(p[4:])
+	c.flags = binary.LittleEndian.Uint32(p[8:])
+	n := binary.LittleEndian.Uint32(p[12:])
+	if size > maxStateChunk || n > 0xffff {
+		return c, ErrBadState
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return c, unexpectedEOF(err)
+	}
+	c.name = string(name)
+	c.size = int(size)
+	return c, nil
+}
+
+// stateWriter is an io.WriteCloser returned by response's OpenState().
+type stateWriter struct {
+	r    *response
+	name string
+}
+
+func (w *stateWriter) Write(p []byte) (n int, err error) {
+	if w.r.state != w {
+		return 0, errStateClosed
+	}
+	for len(p) > 0 {
+		m := len(p)
+		if m > stateChunkSize {
+			m = stateChunkSize
+		}
+		if err := w.r.writeState(w.name, 0, p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (w *stateWriter) Close() error {
+	if w.r.state != w {
+		return nil
+	}
+	w.r.state = nil
+	return w.r.writeState(w.name, stateEnd, nil)
+}
+
+// stateReader is an io.Reader of the state stream passed to StateCallback.
+type stateReader struct {
+	conn *net.UnixConn
+	name string
+	n    int  // Bytes left in the current chunk.
+	end  bool // Current chunk is the last one.
+	err  error
+}
+
+func (s *stateReader) Read(p []byte) (int, error) {
+	for s.n == 0 && s.err == nil {
+		if s.end {
+			s.err = io.EOF
+			break
+		}
+		c, err := readStateChunk(s.conn)
+		if err == nil && c.name != s.name {
+			err = ErrBadState
+		}
+		if err != nil {
+			s.err = unexpectedEOF(err)
+			break
+		}
+		s.n = c.size
+		s.end = c.flags&stateEnd != 0
+	}
+	if s.n == 0 {
+		return 0, s.err
+	}
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.conn.Read(p)
+	s.n -= n
+	if err != nil {
+		s.err = unexpectedEOF(err)
+		return n, s.err
+	}
+	return n, nil
+}
+
+// receiveState reads the state stream from conn and passes it to the
+// callback cb. If cb is nil, the stream is discarded.
+func receiveState(conn *net.UnixConn, cb StateCallback) error {
+	c, err := readStateChunk(conn)
+	if err != nil {
+		return err
+	}
+	s := &stateReader{
+		conn: conn,
+		name: c.name,
+		n:    c.size,
+		end:  c.flags&stateEnd != 0,
+	}
+	if cb != nil {
+		if err := cb(c.name, s); err != nil {
+			return err
+		}
+	}
+	// Discard the rest of the stream.
+	_, err = io.Copy(ioutil.Discard, s)
+	return err
+}
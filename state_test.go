@@ -0,0 +1,91 @@
+package graceful
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	large := make([]byte, 3*stateChunkSize+42)
+	rand.Read(large)
+	small := []byte("rate limiter state")
+
+	ln, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Handler: SequenceHandler(
+		FileHandler(f, nil),
+		StateHandler("cache", func(w io.Writer) error {
+			_, err := w.Write(large)
+			return err
+		}),
+		HandlerFunc(func(_ net.Conn, resp ResponseWriter) {
+			w, err := OpenState(resp, "limiter")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := resp.Write(int(f.Fd()), nil); err != ErrStateOpen {
+				t.Errorf("unexpected error: %v; want %v", err, ErrStateOpen)
+			}
+			w.Write(small)
+			w.Close()
+		}),
+		StateHandler("skipped", func(w io.Writer) error {
+			_, err := w.Write(large)
+			return err
+		}),
+		FileHandler(f, nil),
+	)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	var (
+		states = make(map[string][]byte)
+		order  []string
+	)
+	client := &Client{
+		OnState: func(name string, r io.Reader) error {
+			order = append(order, name)
+			if name == "skipped" {
+				// Read the stream partially.
+				_, err := r.Read(make([]byte, 10))
+				return err
+			}
+			p, err := ioutil.ReadAll(r)
+			states[name] = p
+			return err
+		},
+	}
+	err = client.Receive(ln.Addr().String(), func(fd int, _ io.Reader) error {
+		order = append(order, "fd")
+		return syscall.Close(fd)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := order, []string{"fd", "cache", "limiter", "skipped", "fd"}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("unexpected order of received objects: %v; want %v", act, exp)
+	}
+	if !bytes.Equal(states["cache"], large) {
+		t.Errorf("unexpected large state: %d bytes; want %d", len(states["cache"]), len(large))
+	}
+	if act, exp := states["limiter"], small; !bytes.Equal(act, exp) {
+		t.Errorf("unexpected small state: %q; want %q", act, exp)
+	}
+}
@@ -0,0 +1,83 @@
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment variables used by systemd socket activation protocol.
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFds     = "LISTEN_FDS"
+	envListenFdNames = "LISTEN_FDNAMES"
+)
+
+// listenFdsStart is the first descriptor passed by systemd.
+const listenFdsStart = 3
+
+// ListenFdsName is a name given to the descriptors passed by systemd without
+// LISTEN_FDNAMES.
+const ListenFdsName = "unknown"
+
+// ListenFds returns descriptors passed to the process by systemd socket
+// activation. Descriptors are named by the FileDescriptorName= option of the
+// socket unit and their kinds are detected on the platforms that support it.
+// That is, returned descriptors could be used in the same way as the ones
+// received by ReceiveDescriptors().
+//
+// If process was not activated by systemd, then empty Descriptors and nil
+// error are returned. If unsetEnv is true, then LISTEN_* environment
+// variables are unset, so child processes do not inherit them.
+//
+// Note that all returned descriptors are marked close-on-exec.
+func ListenFds(unsetEnv bool) (*Descriptors, error) {
+	if unsetEnv {
+		defer func() {
+			os.Unsetenv(envListenPID)
+			os.Unsetenv(envListenFds)
+			os.Unsetenv(envListenFdNames)
+		}()
+	}
+	ds := new(Descriptors)
+
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return ds, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFds))
+	if err != nil || n <= 0 {
+		return ds, nil
+	}
+	var names []string
+	if s := os.Getenv(envListenFdNames); s != "" {
+		names = strings.Split(s, ":")
+	}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err != nil {
+			ds.Close()
+			return nil, fmt.Errorf("inherited descriptor %d: %v", fd, err)
+		}
+		syscall.CloseOnExec(fd)
+
+		name := ListenFdsName
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		kind := fdKind(fd)
+		ds.list = append(ds.list, Descriptor{
+			Name: name,
+			Kind: kind,
+			Fd:   fd,
+			Meta: Meta{
+				MetaName: name,
+				MetaKind: kind.String(),
+			},
+		})
+	}
+	return ds, nil
+}
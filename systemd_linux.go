@@ -0,0 +1,35 @@
+package graceful
+
+import "syscall"
+
+// fdKind detects kind of the object which descriptor is fd.
+func fdKind(fd int) Kind {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err == syscall.ENOTSOCK {
+		return KindFile
+	}
+	if err != nil {
+		return KindUnknown
+	}
+	switch typ {
+	case syscall.SOCK_STREAM, syscall.SOCK_SEQPACKET:
+		ln, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return KindUnknown
+		}
+		if ln != 0 {
+			return KindListener
+		}
+		return KindConn
+	case syscall.SOCK_DGRAM:
+		sa, err := syscall.Getsockname(fd)
+		if err != nil {
+			return KindUnknown
+		}
+		if _, ok := sa.(*syscall.SockaddrUnix); ok {
+			return KindUnixgram
+		}
+		return KindPacketConn
+	}
+	return KindUnknown
+}
@@ -0,0 +1,100 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+const envListenFdsTest = "GRACEFUL_TEST_LISTEN_FDS"
+
+func TestListenFds(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var files []*os.File
+	for _, v := range []interface{}{ln, pc} {
+		f, err := fileFrom(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	files = append(files, f)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenFdsChild$")
+	cmd.ExtraFiles = files
+	cmd.Env = append(
+		os.Environ(),
+		envListenFdsTest+"=1",
+		envListenFds+"="+strconv.Itoa(len(files)),
+		envListenFdNames+"=http::log",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process error: %v\n%s", err, out)
+	}
+}
+
+// TestListenFdsChild is run by TestListenFds in a child process with faked
+// systemd environment.
+func TestListenFdsChild(t *testing.T) {
+	if os.Getenv(envListenFdsTest) == "" {
+		t.Skip("not a child process")
+	}
+	// Parent could not know our pid before start.
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	ds, err := ListenFds(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ds.All()); n != 0 {
+		t.Fatalf("received %d descriptors for another pid", n)
+	}
+
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	ds, err = ListenFds(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if os.Getenv(envListenFds) != "" {
+		t.Errorf("environment was not unset")
+	}
+
+	exp := []Descriptor{
+		{Name: "http", Kind: KindListener, Fd: 3},
+		{Name: ListenFdsName, Kind: KindPacketConn, Fd: 4},
+		{Name: "log", Kind: KindFile, Fd: 5},
+	}
+	act := ds.All()
+	if len(act) != len(exp) {
+		t.Fatalf("received %d descriptors; want %d", len(act), len(exp))
+	}
+	for i, d := range act {
+		e := exp[i]
+		if d.Name != e.Name || d.Kind != e.Kind || d.Fd != e.Fd || d.Meta[MetaName] != e.Name {
+			t.Errorf("unexpected descriptor #%d: %+v; want %+v", i, d, e)
+		}
+	}
+	if _, err := ds.Listener("http"); err != nil {
+		t.Errorf("can not rebuild listener: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package graceful
+
+func fdKind(fd int) Kind {
+	return KindUnknown
+}
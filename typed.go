@@ -0,0 +1,173 @@
+//go:build go1.18
+// +build go1.18
+
+package graceful
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// ErrRequired is used within *ValidationError when the required field is
+// missing.
+var ErrRequired = errors.New("required field is missing")
+
+// ValidationError is returned by a callback made by ReceiveTyped() when the
+// received meta is not valid.
+type ValidationError struct {
+	// Field is a name of the invalid field. It is empty if the meta is
+	// invalid as a whole.
+	Field string
+
+	// Err is the reason.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return "invalid meta: " + e.Err.Error()
+	}
+	return fmt.Sprintf("invalid meta field %q: %v", e.Field, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// Validator could be implemented by a type of typed meta to validate itself
+// after it is received. If Validate returns *ValidationError, it is returned
+// as is. Other errors are wrapped into *ValidationError with empty Field.
+type Validator interface {
+	Validate() error
+}
+
+// SendTyped returns meta that carries v encoded as JSON object. It is
+// decodable by ReceiveTyped() as well as by MetaFrom().
+func SendTyped[T any](v T) io.WriterTo {
+	return typedMeta[T]{v}
+}
+
+type typedMeta[T any] struct {
+	v T
+}
+
+func (m typedMeta[T]) WriteTo(w io.Writer) (int64, error) {
+	p, err := json.Marshal(m.v)
+	if err != nil {
+		return 0, err
+	}
+	wc := &writeCounter{W: w}
+	h := [metaHeaderSize]byte{
+		metaMagic[0], metaMagic[1], metaMagic[2], JSONCodec.ID(),
+	}
+	if _, err := wc.Write(h[:]); err != nil {
+		return wc.N, err
+	}
+	_, err = wc.Write(p)
+	return wc.N, err
+}
+
+// ReceiveTyped returns ReceiveCallback that decodes meta of each descriptor
+// into T and calls cb with it. Meta encoded by any codec is accepted: meta
+// that is not sent by SendTyped() is decoded into T as if it was JSON object.
+//
+// Fields of T tagged with `graceful:"required"` must have non-zero values.
+// If T implements Validator, it is validated after decoding as well. If T is
+// a pointer, then the value it points to is validated.
+//
+// If meta can not be decoded or is not valid, then the descriptor is closed
+// and the error is returned, which stops receiving like any other callback
+// error does. Validation errors are *ValidationError.
+func ReceiveTyped[T any](cb func(fd int, v T) error) ReceiveCallback {
+	return func(fd int, meta io.Reader) error {
+		v, err := decodeTyped[T](meta)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		return cb(fd, v)
+	}
+}
+
+func decodeTyped[T any](r io.Reader) (v T, err error) {
+	if r == nil {
+		return v, validateTyped(&v)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return v, err
+	}
+	h := []byte{metaMagic[0], metaMagic[1], metaMagic[2], JSONCodec.ID()}
+	if bytes.HasPrefix(p, h) {
+		p = p[len(h):]
+	} else {
+		// Meta is encoded by another codec. Convert it to JSON first.
+		m, err := decodeMeta(bytes.NewReader(p))
+		if err != nil {
+			return v, err
+		}
+		if p, err = json.Marshal(m); err != nil {
+			return v, err
+		}
+	}
+	if err := json.Unmarshal(p, &v); err != nil {
+		if terr, ok := err.(*json.UnmarshalTypeError); ok && terr.Field != "" {
+			return v, &ValidationError{Field: terr.Field, Err: err}
+		}
+		return v, err
+	}
+	return v, validateTyped(&v)
+}
+
+// validateTyped validates the decoded meta v, which is a pointer to T. If T is
+// a pointer itself, then it is dereferenced down to the value it points to.
+// Nil pointer is validated as a pointer to zero value.
+func validateTyped(v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	for ptr.Elem().Kind() == reflect.Ptr {
+		if ptr.Elem().IsNil() {
+			ptr = reflect.New(ptr.Elem().Type().Elem())
+		} else {
+			ptr = ptr.Elem()
+		}
+	}
+	if rv := ptr.Elem(); rv.Kind() == reflect.Struct {
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if f.Tag.Get("graceful") != "required" {
+				continue
+			}
+			if rv.Field(i).IsZero() {
+				return &ValidationError{
+					Field: jsonName(f),
+					Err:   ErrRequired,
+				}
+			}
+		}
+	}
+	x, ok := ptr.Interface().(Validator)
+	if !ok {
+		return nil
+	}
+	err := x.Validate()
+	if _, ok := err.(*ValidationError); err == nil || ok {
+		return err
+	}
+	return &ValidationError{Err: err}
+}
+
+// jsonName returns the name of the field f as it is encoded in JSON.
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
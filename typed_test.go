@@ -0,0 +1,149 @@
+//go:build go1.18
+// +build go1.18
+
+package graceful
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type testTypedMeta struct {
+	Name string `json:"name" graceful:"required"`
+	Port int    `json:"port"`
+}
+
+func (m *testTypedMeta) Validate() error {
+	if m.Port < 0 {
+		return &ValidationError{Field: "port", Err: errors.New("negative port")}
+	}
+	return nil
+}
+
+func TestTyped(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		meta  io.WriterTo
+		ptr   bool
+		exp   testTypedMeta
+		field string
+	}{
+		{
+			name: "typed",
+			meta: SendTyped(testTypedMeta{Name: "http", Port: 80}),
+			exp:  testTypedMeta{Name: "http", Port: 80},
+		},
+		{
+			name: "gob",
+			meta: Meta{"name": "http", "port": 80},
+			exp:  testTypedMeta{Name: "http", Port: 80},
+		},
+		{
+			name: "kv",
+			meta: Meta{"name": "http", "port": 80}.WithCodec(KVCodec),
+			exp:  testTypedMeta{Name: "http", Port: 80},
+		},
+		{
+			name:  "required",
+			meta:  SendTyped(testTypedMeta{Port: 80}),
+			field: "name",
+		},
+		{
+			name:  "validator",
+			meta:  SendTyped(testTypedMeta{Name: "http", Port: -1}),
+			field: "port",
+		},
+		{
+			name:  "type mismatch",
+			meta:  Meta{"name": 42},
+			field: "name",
+		},
+		{
+			name: "pointer",
+			meta: SendTyped(testTypedMeta{Name: "http", Port: 80}),
+			ptr:  true,
+			exp:  testTypedMeta{Name: "http", Port: 80},
+		},
+		{
+			name:  "pointer required",
+			meta:  SendTyped(testTypedMeta{Port: 80}),
+			ptr:   true,
+			field: "name",
+		},
+		{
+			name:  "pointer validator",
+			meta:  SendTyped(testTypedMeta{Name: "http", Port: -1}),
+			ptr:   true,
+			field: "port",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server, err := unixSocketpair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			f, err := ioutil.TempFile(tempFileDir, tempFilePrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			// Send the same descriptor twice within a frame to check that
+			// receiving stops on the first validation error and the rest of
+			// the frame is closed.
+			rw := defaultResponseWriter(server)
+			for i := 0; i < 2; i++ {
+				if err := rw.Write(int(f.Fd()), test.meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+
+			var received []testTypedMeta
+			cb := ReceiveTyped(func(fd int, m testTypedMeta) error {
+				received = append(received, m)
+				return syscall.Close(fd)
+			})
+			if test.ptr {
+				cb = ReceiveTyped(func(fd int, m *testTypedMeta) error {
+					received = append(received, *m)
+					return syscall.Close(fd)
+				})
+			}
+			before := openFds(t)
+			err = ReceiveAllFrom(client, cb)
+			if act, exp := openFds(t), before; act != exp {
+				t.Errorf("unexpected number of open descriptors: %d; want %d", act, exp)
+			}
+			if test.field == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(received) != 2 || received[0] != test.exp || received[1] != test.exp {
+					t.Errorf("unexpected received meta: %+v; want 2 of %+v", received, test.exp)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("unexpected error: %v; want *ValidationError", err)
+			}
+			if verr.Field != test.field {
+				t.Errorf("unexpected invalid field: %q; want %q", verr.Field, test.field)
+			}
+			if len(received) != 0 {
+				t.Errorf("unexpected callback calls: %d", len(received))
+			}
+		})
+	}
+}
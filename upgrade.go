@@ -0,0 +1,391 @@
+package graceful
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrChildExited is returned by the Upgrader when the new process exits or
+// closes the upgrade connection before it reports readiness.
+var ErrChildExited = errors.New("child process exited before it was ready")
+
+// envUpgradeFd is an environment variable that holds the number of the
+// descriptor of the upgrade connection.
+const envUpgradeFd = "GRACEFUL_UPGRADE_FD"
+
+// upgradeFdsStart is the first descriptor passed by the Upgrader. The upgrade
+// connection is passed as the first extra file before it.
+const upgradeFdsStart = listenFdsStart + 1
+
+// Upgrader starts a new instance of the application and passes objects of
+// the Registry to it through inherited descriptors.
+//
+// Names, kinds and meta of the passed objects are sent to the new process
+// over a dedicated unix connection, which is also used by the new process to
+// report its readiness. The new process gets passed objects by calling
+// UpgradeFds() (or Inherit()) and reports readiness by calling Ready() (or
+// UpgradeReady()).
+type Upgrader struct {
+	// Registry contains objects to be passed to the new process.
+	Registry *Registry
+
+	// Path is a path to the executable of the new process. If Path is empty,
+	// then the executable of the current process is used.
+	Path string
+
+	// Args holds command line arguments of the new process, not including
+	// the command name. If Args is nil, then the arguments of the current
+	// process are used.
+	Args []string
+
+	// Env specifies the environment of the new process. If Env is nil, then
+	// the environment of the current process is used.
+	Env []string
+
+	// Stdout and Stderr specify the new process's standard output and error.
+	// If they are nil, then the streams of the current process are used.
+	//
+	// If they are not *os.File, then the output is copied by the current
+	// process until the Wait() method of the command returned by Upgrade()
+	// is done. Thus the output is lost after the current process exits.
+	Stdout, Stderr io.Writer
+
+	// ReadyTimeout limits the time the new process has to report readiness.
+	// If ReadyTimeout is zero, then only the context passed to Upgrade()
+	// limits it.
+	ReadyTimeout time.Duration
+
+	// Notifier is an optional systemd notifier. If it is not nil, then
+	// Upgrade() notifies systemd that service is reloading before starting
+	// the new process. Then it notifies systemd about the new main process if
+	// it is ready or about the end of reload otherwise.
+	Notifier *Notifier
+}
+
+// Upgrade starts a new process and waits for it to report readiness.
+//
+// It returns the command of the new process if it is ready to serve. Then the
+// current process is expected to drain and exit. Caller may call Wait() method
+// of the command to wait for the new process to exit and for its output to be
+// copied (see Stdout and Stderr). If the process is not ready before
+// ctx is done or ReadyTimeout expires, reports failure (as *NackError) or
+// exits (as ErrChildExited), then it is killed and error is returned. In that
+// case the current process should keep serving.
+//
+// If Notifier is set and it fails to notify systemd about the new main
+// process, then Upgrade() returns the ready process along with the error.
+func (u *Upgrader) Upgrade(ctx context.Context) (*exec.Cmd, error) {
+	if u.Notifier != nil {
+		if err := u.Notifier.Reloading(); err != nil {
+			return nil, err
+		}
+	}
+	cmd, err := u.upgrade(ctx)
+	if u.Notifier == nil {
+		return cmd, err
+	}
+	if err != nil {
+		// Error is not checked here cause upgrade error is more important.
+		u.Notifier.Ready()
+		return nil, err
+	}
+	return cmd, u.Notifier.MainPID(cmd.Process.Pid)
+}
+
+func (u *Upgrader) upgrade(ctx context.Context) (*exec.Cmd, error) {
+	if u.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.ReadyTimeout)
+		defer cancel()
+	}
+
+	msg, files, err := u.Registry.frame()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(msg)+frameTrailerSize > maxFrameSize || len(files) > maxFrameFds {
+		return nil, fmt.Errorf(
+			"graceful: registry is too large to pass: %d objects", len(files),
+		)
+	}
+
+	conn, child, err := upgradeSocketpair()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	cmd, err := u.command()
+	if err != nil {
+		child.Close()
+		return nil, err
+	}
+	cmd.Env = append(cmd.Env, envUpgradeFd+"="+strconv.Itoa(listenFdsStart))
+	cmd.ExtraFiles = append([]*os.File{child}, files...)
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, conn)
+	err = writeUpgrade(conn, msg, len(files))
+	if err == nil {
+		err = readAck(conn)
+	}
+	stop()
+	if err == nil {
+		return cmd, nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if isEOF(err) || err == io.ErrUnexpectedEOF {
+		err = ErrChildExited
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, err
+}
+
+func (u *Upgrader) command() (*exec.Cmd, error) {
+	path := u.Path
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return nil, err
+		}
+	}
+	args := u.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(path, args...)
+	// Copy the environment, so appending to it does not modify u.Env.
+	cmd.Env = append([]string(nil), u.Env...)
+	if u.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = u.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = u.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd, nil
+}
+
+// frame returns frame message describing all registered objects and the files
+// of those objects in the same order. Returned files must be closed after
+// use. Nil Registry is treated as empty one.
+func (r *Registry) frame() (msg []byte, files []*os.File, err error) {
+	if r == nil {
+		return nil, nil, nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var buf bytes.Buffer
+	for _, name := range r.names {
+		e := r.entries[name]
+
+		var f *os.File
+		if file, ok := e.value.(*os.File); ok {
+			// Make a dup to be able to close all files regardless of their
+			// origin.
+			f, err = dupFile(file)
+		} else {
+			f, err = fileFrom(e.value)
+		}
+		if err != nil {
+			break
+		}
+		files = append(files, f)
+
+		var meta bytes.Buffer
+		if _, err = e.meta.WithCodec(r.MetaCodec).WriteTo(&meta); err != nil {
+			break
+		}
+		ent := entry{
+			name: name,
+			kind: e.kind,
+		}
+		if s, ok := e.meta[MetaKind].(string); ok {
+			// Kind in meta is refined by the address of the object.
+			ent.kind = ParseKind(s)
+		}
+		p := make([]byte, ent.headerSize(true))
+		ent.putHeader(p, true, meta.Len())
+		buf.Write(p)
+		buf.Write(meta.Bytes())
+	}
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, nil, err
+	}
+	return buf.Bytes(), files, nil
+}
+
+func dupFile(file *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), file.Name()), nil
+}
+
+// upgradeSocketpair returns connected pair of unix sockets. First one is
+// used by the current process and the second one is passed to the new one.
+func upgradeSocketpair() (*net.UnixConn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	nc, err := FdConn(fds[0])
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return nc.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "graceful-upgrade"), nil
+}
+
+func writeUpgrade(conn *net.UnixConn, msg []byte, fdn int) error {
+	msg = appendFrameTrailer(msg, fdn)
+	err := writeFrameHeader(conn, frameHeader{
+		msgn:  len(msg),
+		fdn:   fdn,
+		flags: frameNamed | frameChecksum,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFull(conn, msg)
+}
+
+var upgrade struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// UpgradeFds returns descriptors passed to the process by the Upgrader of the
+// parent process. Returned descriptors could be used in the same way as the
+// ones received by ReceiveDescriptors().
+//
+// If process was not started by the Upgrader, then empty Descriptors and nil
+// error are returned. If unsetEnv is true, then the upgrade environment
+// variable is unset, so child processes do not inherit it.
+//
+// Note that all returned descriptors are marked close-on-exec.
+func UpgradeFds(unsetEnv bool) (*Descriptors, error) {
+	if unsetEnv {
+		defer os.Unsetenv(envUpgradeFd)
+	}
+	ds := new(Descriptors)
+
+	fd, err := strconv.Atoi(os.Getenv(envUpgradeFd))
+	if err != nil || fd < 0 {
+		return ds, nil
+	}
+	syscall.CloseOnExec(fd)
+	nc, err := FdConn(fd)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade connection: %v", err)
+	}
+	conn, ok := nc.(*net.UnixConn)
+	if !ok {
+		nc.Close()
+		return nil, ErrNotUnixConn
+	}
+
+	p := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if string(p[:4]) != string(frameMagic[:]) {
+		conn.Close()
+		return nil, ErrBadHello
+	}
+	h, err := decodeFrameHeader(p)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msg := make([]byte, h.msgn)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if h.flags&frameChecksum != 0 {
+		if msg, err = checkFrameIntegrity(msg, h); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	entries, off := parseEntries(msg, true)
+	if off < len(msg) || countFds(entries) != h.fdn {
+		conn.Close()
+		return nil, &TruncateError{
+			Err:       ErrMessageTruncated,
+			Announced: h.fdn,
+		}
+	}
+	fd = upgradeFdsStart
+	for _, e := range entries {
+		if !e.hasFd() {
+			continue
+		}
+		e.fd = fd
+		fd++
+		syscall.CloseOnExec(e.fd)
+		ds.add(e, bytes.NewReader(e.meta))
+	}
+
+	upgrade.mu.Lock()
+	if upgrade.conn != nil {
+		upgrade.conn.Close()
+	}
+	upgrade.conn = conn
+	upgrade.mu.Unlock()
+
+	return ds, nil
+}
+
+// UpgradeReady reports to the Upgrader of the parent process that the process
+// is ready to serve. If err is non-nil, then it reports failure instead and
+// the parent process keeps serving.
+//
+// It is a no-op if process was not started by the Upgrader or UpgradeFds()
+// was not called.
+func UpgradeReady(err error) error {
+	upgrade.mu.Lock()
+	conn := upgrade.conn
+	upgrade.conn = nil
+	upgrade.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+	return writeAck(conn, err)
+}
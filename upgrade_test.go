@@ -0,0 +1,128 @@
+package graceful
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	envUpgradeTest     = "GRACEFUL_TEST_UPGRADE"
+	envUpgradeTestAddr = "GRACEFUL_TEST_UPGRADE_ADDR"
+)
+
+func TestUpgrader(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var reg Registry
+	if err := reg.RegisterListener("http", ln); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		mode    string
+		timeout time.Duration
+		err     error
+	}{
+		{
+			name: "ready",
+			mode: "ready",
+		},
+		{
+			name: "fail",
+			mode: "fail",
+			err:  &NackError{Reason: "child failure"},
+		},
+		{
+			name: "exit",
+			mode: "exit",
+			err:  ErrChildExited,
+		},
+		{
+			name:    "timeout",
+			mode:    "hang",
+			timeout: 100 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.timeout == 0 {
+				test.timeout = 10 * time.Second
+			}
+			var out bytes.Buffer
+			u := Upgrader{
+				Registry: &reg,
+				Path:     os.Args[0],
+				Args:     []string{"-test.run=^TestUpgraderChild$"},
+				Env: append(
+					os.Environ(),
+					envUpgradeTest+"="+test.mode,
+					envUpgradeTestAddr+"="+ln.Addr().String(),
+				),
+				Stdout:       &out,
+				Stderr:       &out,
+				ReadyTimeout: test.timeout,
+			}
+			cmd, err := u.Upgrade(context.Background())
+			if env := u.Env[:cap(u.Env)]; len(env) > len(u.Env) && env[len(u.Env)] != "" {
+				t.Errorf("Upgrade() modified spare capacity of Env: %q", env[len(u.Env)])
+			}
+			if test.err == nil && err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, out.Bytes())
+			}
+			if test.err != nil {
+				if err == nil || err.Error() != test.err.Error() {
+					t.Fatalf("unexpected error: %v; want %v", err, test.err)
+				}
+				return
+			}
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("child process failed: %v\n%s", err, out.Bytes())
+			}
+		})
+	}
+}
+
+// TestUpgraderChild is run by TestUpgrader in a child process.
+func TestUpgraderChild(t *testing.T) {
+	mode := os.Getenv(envUpgradeTest)
+	if mode == "" {
+		t.Skip("not a child process")
+	}
+	ds, err := UpgradeFds(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	switch mode {
+	case "fail":
+		UpgradeReady(errors.New("child failure"))
+		return
+	case "exit":
+		os.Exit(0)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+
+	ln, err := ds.Listener("http")
+	if err != nil {
+		UpgradeReady(err)
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if act, exp := ln.Addr().String(), os.Getenv(envUpgradeTestAddr); act != exp {
+		t.Errorf("unexpected listener address: %q; want %q", act, exp)
+	}
+	if err := UpgradeReady(nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,11 @@
 package graceful
 
 import (
+	"context"
 	"net"
 	"os"
+	"syscall"
+	"time"
 )
 
 // FdListener is a helper function that converts given descriptor to the
@@ -41,6 +44,50 @@ func nameConn(conn net.Conn) string {
 		" > " + conn.RemoteAddr().Network() + ":" + conn.RemoteAddr().String()
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancelation of i/o operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext interrupts blocking i/o on conn when ctx is done. Returned
+// function must be called when i/o is finished.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// underlyingError returns error wrapped by *net.OpError and *os.SyscallError.
+func underlyingError(err error) error {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err
+}
+
+// isErrno reports whether err is caused by errno.
+func isErrno(err error, errno syscall.Errno) bool {
+	return underlyingError(err) == errno
+}
+
 func nonZero(a, b int) int {
 	if a != 0 {
 		return a